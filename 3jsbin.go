@@ -1,14 +1,19 @@
 package bin
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 )
 
 const (
 	JS3_BIN_SIGN = "Three.js 002"
+
+	headerSize uint8 = 64
 )
 
 var (
@@ -18,6 +23,9 @@ var (
 type FlatTriangle struct {
 	Vertices [][3]uint32
 	Material []uint16
+	// Colors indexes Binobj.Colors per corner. The binary format has no
+	// colors, so these only come from JSON models and are not encoded.
+	Colors [][3]uint32
 }
 
 func (obj *FlatTriangle) GetVertices() []uint32 {
@@ -34,36 +42,37 @@ func (obj *FlatTriangle) GetMaterials() []uint16 {
 	return obj.Material
 }
 
-func (obj *FlatTriangle) encode(wr io.Writer) error {
-	if len(obj.Vertices) != len(obj.Material) {
-		return errors.New("Vertices size must eq")
-	}
-
-	err := binary.Write(wr, littleEndian, obj.GetVertices())
-	if err != nil {
-		return err
+func (obj *FlatTriangle) GetColors() []uint32 {
+	ret := make([]uint32, len(obj.Colors)*3)
+	for i := range obj.Colors {
+		ret[i*3] = obj.Colors[i][0]
+		ret[i*3+1] = obj.Colors[i][1]
+		ret[i*3+2] = obj.Colors[i][2]
 	}
+	return ret
+}
 
-	err = binary.Write(wr, littleEndian, obj.GetMaterials())
-	if err != nil {
-		return err
+func (obj *FlatTriangle) encode(wr io.Writer, h *Header) error {
+	if len(obj.Vertices) != len(obj.Material) {
+		return errors.New("Vertices size must eq")
 	}
+	return writeIndices(wr, h.VertexIndexBytes, obj.GetVertices())
+}
 
-	return nil
+func (obj *FlatTriangle) encodeMtl(wr io.Writer, h *Header) error {
+	return writeMaterials(wr, h.MaterialIndexBytes, obj.GetMaterials())
 }
 
-func (obj *FlatTriangle) decode(rd io.ReadSeeker, size uint32) error {
-	verbuf := make([]uint32, size*3)
-	err := binary.Read(rd, littleEndian, verbuf)
+func (obj *FlatTriangle) decode(rd io.Reader, size uint32, h *Header) error {
+	verbuf, err := readIndices(rd, h.VertexIndexBytes, uint64(size)*3)
 	if err != nil {
 		return err
 	}
 	return obj.SetVertices(verbuf)
 }
 
-func (obj *FlatTriangle) decodeMtl(rd io.ReadSeeker, size uint32) error {
-	mtlbuf := make([]uint16, size)
-	err := binary.Read(rd, littleEndian, mtlbuf)
+func (obj *FlatTriangle) decodeMtl(rd io.Reader, size uint32, h *Header) error {
+	mtlbuf, err := readMaterials(rd, h.MaterialIndexBytes, uint64(size))
 	if err != nil {
 		return err
 	}
@@ -120,12 +129,12 @@ func (obj *SmoothTriangle) GetNormals() []uint32 {
 	return ret
 }
 
-func (obj *SmoothTriangle) encode(wr io.Writer) error {
-	err := obj.FlatTriangle.encode(wr)
+func (obj *SmoothTriangle) encode(wr io.Writer, h *Header) error {
+	err := obj.FlatTriangle.encode(wr, h)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(wr, littleEndian, obj.GetNormals())
+	err = writeIndices(wr, h.NormalIndexBytes, obj.GetNormals())
 	if err != nil {
 		return err
 	}
@@ -133,13 +142,12 @@ func (obj *SmoothTriangle) encode(wr io.Writer) error {
 	return nil
 }
 
-func (obj *SmoothTriangle) decode(rd io.ReadSeeker, size uint32) error {
-	err := obj.FlatTriangle.decode(rd, size)
+func (obj *SmoothTriangle) decode(rd io.Reader, size uint32, h *Header) error {
+	err := obj.FlatTriangle.decode(rd, size, h)
 	if err != nil {
 		return err
 	}
-	verbuf := make([]uint32, size*3)
-	err = binary.Read(rd, littleEndian, verbuf)
+	verbuf, err := readIndices(rd, h.NormalIndexBytes, uint64(size)*3)
 	if err != nil {
 		return err
 	}
@@ -190,12 +198,12 @@ func (obj *FlatUVTriangle) GetUvs() []uint32 {
 	return ret
 }
 
-func (obj *FlatUVTriangle) encode(wr io.Writer) error {
-	err := obj.FlatTriangle.encode(wr)
+func (obj *FlatUVTriangle) encode(wr io.Writer, h *Header) error {
+	err := obj.FlatTriangle.encode(wr, h)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(wr, littleEndian, obj.GetUvs())
+	err = writeIndices(wr, h.UVIndexBytes, obj.GetUvs())
 	if err != nil {
 		return err
 	}
@@ -203,13 +211,12 @@ func (obj *FlatUVTriangle) encode(wr io.Writer) error {
 	return nil
 }
 
-func (obj *FlatUVTriangle) decode(rd io.ReadSeeker, size uint32) error {
-	err := obj.FlatTriangle.decode(rd, size)
+func (obj *FlatUVTriangle) decode(rd io.Reader, size uint32, h *Header) error {
+	err := obj.FlatTriangle.decode(rd, size, h)
 	if err != nil {
 		return err
 	}
-	uvbuf := make([]uint32, size*3)
-	err = binary.Read(rd, littleEndian, uvbuf)
+	uvbuf, err := readIndices(rd, h.UVIndexBytes, uint64(size)*3)
 	if err != nil {
 		return err
 	}
@@ -271,17 +278,17 @@ func (obj *SmoothUVTriangle) GetUvs() []uint32 {
 	return ret
 }
 
-func (obj *SmoothUVTriangle) encode(wr io.Writer) error {
-	err := obj.FlatTriangle.encode(wr)
+func (obj *SmoothUVTriangle) encode(wr io.Writer, h *Header) error {
+	err := obj.FlatTriangle.encode(wr, h)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(wr, littleEndian, obj.GetNormals())
+	err = writeIndices(wr, h.NormalIndexBytes, obj.GetNormals())
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(wr, littleEndian, obj.GetUvs())
+	err = writeIndices(wr, h.UVIndexBytes, obj.GetUvs())
 	if err != nil {
 		return err
 	}
@@ -289,13 +296,12 @@ func (obj *SmoothUVTriangle) encode(wr io.Writer) error {
 	return nil
 }
 
-func (obj *SmoothUVTriangle) decode(rd io.ReadSeeker, size uint32) error {
-	err := obj.FlatTriangle.decode(rd, size)
+func (obj *SmoothUVTriangle) decode(rd io.Reader, size uint32, h *Header) error {
+	err := obj.FlatTriangle.decode(rd, size, h)
 	if err != nil {
 		return err
 	}
-	verbuf := make([]uint32, size*3)
-	err = binary.Read(rd, littleEndian, verbuf)
+	verbuf, err := readIndices(rd, h.NormalIndexBytes, uint64(size)*3)
 	if err != nil {
 		return err
 	}
@@ -304,8 +310,7 @@ func (obj *SmoothUVTriangle) decode(rd io.ReadSeeker, size uint32) error {
 		return err
 	}
 
-	uvbuf := make([]uint32, size*3)
-	err = binary.Read(rd, littleEndian, uvbuf)
+	uvbuf, err := readIndices(rd, h.UVIndexBytes, uint64(size)*3)
 	if err != nil {
 		return err
 	}
@@ -369,6 +374,7 @@ func (obj *SmoothUVTriangle) SetUVs(vers interface{}) error {
 type FlatQuad struct {
 	Vertices [][4]uint32
 	Material []uint16
+	Colors   [][4]uint32
 }
 
 func (obj *FlatQuad) GetVertices() []uint32 {
@@ -386,35 +392,38 @@ func (obj *FlatQuad) GetMaterials() []uint16 {
 	return obj.Material
 }
 
-func (obj *FlatQuad) encode(wr io.Writer) error {
-	if len(obj.Vertices) != len(obj.Material) {
-		return errors.New("Vertices size must eq")
+func (obj *FlatQuad) GetColors() []uint32 {
+	ret := make([]uint32, len(obj.Colors)*4)
+	for i := range obj.Colors {
+		ret[i*4] = obj.Colors[i][0]
+		ret[i*4+1] = obj.Colors[i][1]
+		ret[i*4+2] = obj.Colors[i][2]
+		ret[i*4+3] = obj.Colors[i][3]
 	}
+	return ret
+}
 
-	err := binary.Write(wr, littleEndian, obj.GetVertices())
-	if err != nil {
-		return err
+func (obj *FlatQuad) encode(wr io.Writer, h *Header) error {
+	if len(obj.Vertices) != len(obj.Material) {
+		return errors.New("Vertices size must eq")
 	}
+	return writeIndices(wr, h.VertexIndexBytes, obj.GetVertices())
+}
 
-	err = binary.Write(wr, littleEndian, obj.GetMaterials())
-	if err != nil {
-		return err
-	}
-	return nil
+func (obj *FlatQuad) encodeMtl(wr io.Writer, h *Header) error {
+	return writeMaterials(wr, h.MaterialIndexBytes, obj.GetMaterials())
 }
 
-func (obj *FlatQuad) decode(rd io.ReadSeeker, size uint32) error {
-	verbuf := make([]uint32, size*4)
-	err := binary.Read(rd, littleEndian, verbuf)
+func (obj *FlatQuad) decode(rd io.Reader, size uint32, h *Header) error {
+	verbuf, err := readIndices(rd, h.VertexIndexBytes, uint64(size)*4)
 	if err != nil {
 		return err
 	}
 	return obj.SetVertices(verbuf)
 }
 
-func (obj *FlatQuad) decodeMtl(rd io.ReadSeeker, size uint32) error {
-	mtlbuf := make([]uint16, size)
-	err := binary.Read(rd, littleEndian, mtlbuf)
+func (obj *FlatQuad) decodeMtl(rd io.Reader, size uint32, h *Header) error {
+	mtlbuf, err := readMaterials(rd, h.MaterialIndexBytes, uint64(size))
 	if err != nil {
 		return err
 	}
@@ -474,26 +483,25 @@ func (obj *SmoothQuad) GetNormals() []uint32 {
 	return ret
 }
 
-func (obj *SmoothQuad) encode(wr io.Writer) error {
-	err := obj.FlatQuad.encode(wr)
+func (obj *SmoothQuad) encode(wr io.Writer, h *Header) error {
+	err := obj.FlatQuad.encode(wr, h)
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(wr, littleEndian, obj.GetNormals())
+	err = writeIndices(wr, h.NormalIndexBytes, obj.GetNormals())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (obj *SmoothQuad) decode(rd io.ReadSeeker, size uint32) error {
-	err := obj.FlatQuad.decode(rd, size)
+func (obj *SmoothQuad) decode(rd io.Reader, size uint32, h *Header) error {
+	err := obj.FlatQuad.decode(rd, size, h)
 	if err != nil {
 		return err
 	}
-	verbuf := make([]uint32, size*4)
-	err = binary.Read(rd, littleEndian, verbuf)
+	verbuf, err := readIndices(rd, h.NormalIndexBytes, uint64(size)*4)
 	if err != nil {
 		return err
 	}
@@ -547,26 +555,25 @@ func (obj *FlatUVQuad) GetUvs() []uint32 {
 	return ret
 }
 
-func (obj *FlatUVQuad) encode(wr io.Writer) error {
-	err := obj.FlatQuad.encode(wr)
+func (obj *FlatUVQuad) encode(wr io.Writer, h *Header) error {
+	err := obj.FlatQuad.encode(wr, h)
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(wr, littleEndian, obj.GetUvs())
+	err = writeIndices(wr, h.UVIndexBytes, obj.GetUvs())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (obj *FlatUVQuad) decode(rd io.ReadSeeker, size uint32) error {
-	err := obj.FlatQuad.decode(rd, size)
+func (obj *FlatUVQuad) decode(rd io.Reader, size uint32, h *Header) error {
+	err := obj.FlatQuad.decode(rd, size, h)
 	if err != nil {
 		return err
 	}
-	uvbuf := make([]uint32, size*4)
-	err = binary.Read(rd, littleEndian, uvbuf)
+	uvbuf, err := readIndices(rd, h.UVIndexBytes, uint64(size)*4)
 	if err != nil {
 		return err
 	}
@@ -632,31 +639,30 @@ func (obj *SmoothUVQuad) GetUvs() []uint32 {
 	return ret
 }
 
-func (obj *SmoothUVQuad) encode(wr io.Writer) error {
-	err := obj.FlatQuad.encode(wr)
+func (obj *SmoothUVQuad) encode(wr io.Writer, h *Header) error {
+	err := obj.FlatQuad.encode(wr, h)
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(wr, littleEndian, obj.GetNormals())
+	err = writeIndices(wr, h.NormalIndexBytes, obj.GetNormals())
 	if err != nil {
 		return err
 	}
 
-	err = binary.Write(wr, littleEndian, obj.GetUvs())
+	err = writeIndices(wr, h.UVIndexBytes, obj.GetUvs())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (obj *SmoothUVQuad) decode(rd io.ReadSeeker, size uint32) error {
-	err := obj.FlatQuad.decode(rd, size)
+func (obj *SmoothUVQuad) decode(rd io.Reader, size uint32, h *Header) error {
+	err := obj.FlatQuad.decode(rd, size, h)
 	if err != nil {
 		return err
 	}
-	verbuf := make([]uint32, size*4)
-	err = binary.Read(rd, littleEndian, verbuf)
+	verbuf, err := readIndices(rd, h.NormalIndexBytes, uint64(size)*4)
 	if err != nil {
 		return err
 	}
@@ -665,8 +671,7 @@ func (obj *SmoothUVQuad) decode(rd io.ReadSeeker, size uint32) error {
 		return err
 	}
 
-	uvbuf := make([]uint32, size*4)
-	err = binary.Read(rd, littleEndian, uvbuf)
+	uvbuf, err := readIndices(rd, h.UVIndexBytes, uint64(size)*4)
 	if err != nil {
 		return err
 	}
@@ -763,7 +768,7 @@ func (h *Header) SetDefault() {
 	for i := range h.Signature {
 		h.Signature[i] = JS3_BIN_SIGN[i]
 	}
-	h.HeaderBytes = 64
+	h.HeaderBytes = headerSize
 	h.VertexCoordinateBytes = 4
 	h.NormalCoordinateBytes = 1
 	h.UVCoordinateBytes = 4
@@ -790,7 +795,12 @@ func (h *Header) SetDefault() {
 
 func (h *Header) setup(obj *Binobj) {
 	h.SetDefault()
+	h.counts(obj)
+}
 
+// counts sets the element and face counts from the arrays of obj and leaves
+// the byte widths alone.
+func (h *Header) counts(obj *Binobj) {
 	h.VerticeCount = uint32(len(obj.Vectilers))
 	h.NormalCount = uint32(len(obj.Normals))
 	h.UVCount = uint32(len(obj.UVs))
@@ -806,11 +816,44 @@ func (h *Header) setup(obj *Binobj) {
 	h.QuadSmoothUVCount = uint32(len(obj.SmoothUVQuad.Material))
 }
 
+func (h *Header) check() error {
+	if h.HeaderBytes < headerSize {
+		return fmt.Errorf("header bytes %d too small", h.HeaderBytes)
+	}
+	if h.VertexCoordinateBytes != 4 && h.VertexCoordinateBytes != 8 {
+		return fmt.Errorf("unsupported vertex coordinate bytes %d", h.VertexCoordinateBytes)
+	}
+	if h.NormalCoordinateBytes != 1 {
+		return fmt.Errorf("unsupported normal coordinate bytes %d", h.NormalCoordinateBytes)
+	}
+	if h.UVCoordinateBytes != 4 && h.UVCoordinateBytes != 8 {
+		return fmt.Errorf("unsupported uv coordinate bytes %d", h.UVCoordinateBytes)
+	}
+	for _, b := range []uint8{h.VertexIndexBytes, h.NormalIndexBytes, h.UVIndexBytes, h.MaterialIndexBytes} {
+		if b != 1 && b != 2 && b != 4 {
+			return fmt.Errorf("unsupported index bytes %d", b)
+		}
+	}
+	return nil
+}
+
+func (h *Header) faceBytes(corners uint32, normal, uv bool) uint32 {
+	n := corners * uint32(h.VertexIndexBytes)
+	if normal {
+		n += corners * uint32(h.NormalIndexBytes)
+	}
+	if uv {
+		n += corners * uint32(h.UVIndexBytes)
+	}
+	return n + uint32(h.MaterialIndexBytes)
+}
+
 type Binobj struct {
 	Header           Header
 	Vectilers        [][3]float32
 	Normals          [][3]int8
 	UVs              [][2]float32
+	Colors           []uint32
 	FlatTriangle     FlatTriangle
 	SmoothTriangle   SmoothTriangle
 	FlatUVTriangle   FlatUVTriangle
@@ -825,6 +868,33 @@ func (obj *Binobj) Setup() {
 	obj.Header.setup(obj)
 }
 
+func (obj *Binobj) SetupCompact() {
+	obj.Header.setup(obj)
+
+	maxIndex := func(n uint32) uint32 {
+		if n == 0 {
+			return 0
+		}
+		return n - 1
+	}
+	obj.Header.VertexIndexBytes = indexBytes(maxIndex(obj.Header.VerticeCount))
+	obj.Header.NormalIndexBytes = indexBytes(maxIndex(obj.Header.NormalCount))
+	obj.Header.UVIndexBytes = indexBytes(maxIndex(obj.Header.UVCount))
+
+	var mtl uint16
+	for _, mtls := range [][]uint16{
+		obj.FlatTriangle.Material, obj.SmoothTriangle.Material, obj.FlatUVTriangle.Material, obj.SmoothUVTriangle.Material,
+		obj.FlatQuad.Material, obj.SmoothQuad.Material, obj.FlatUVQuad.Material, obj.SmoothUVQuad.Material,
+	} {
+		for _, m := range mtls {
+			if m > mtl {
+				mtl = m
+			}
+		}
+	}
+	obj.Header.MaterialIndexBytes = indexBytes(uint32(mtl))
+}
+
 func (obj *Binobj) GetVectilers() []float32 {
 	ret := make([]float32, len(obj.Vectilers)*3)
 	for i := range obj.Vectilers {
@@ -900,10 +970,60 @@ func (obj *Binobj) SetNormals(norm interface{}) error {
 		}
 	case [][3]int8:
 		obj.Normals = t
+	case []float32:
+		if len(t)%3 != 0 {
+			return errors.New("[]float32 must 3^")
+		}
+		obj.Normals = make([][3]int8, len(t)/3)
+		for i := range obj.Normals {
+			obj.Normals[i] = EncodeNormal([3]float32{t[i*3], t[i*3+1], t[i*3+2]})
+		}
+	case [][3]float32:
+		obj.Normals = make([][3]int8, len(t))
+		for i := range obj.Normals {
+			obj.Normals[i] = EncodeNormal(t[i])
+		}
 	}
 	return nil
 }
 
+func (obj *Binobj) GetDecodedNormals() [][3]float32 {
+	ret := make([][3]float32, len(obj.Normals))
+	for i := range obj.Normals {
+		ret[i] = DecodeNormal(obj.Normals[i])
+	}
+	return ret
+}
+
+// DecodeNormal expands a normal quantized to [-127, 127] per component into
+// a unit vector. Zero normals decode to +Z.
+func DecodeNormal(n [3]int8) [3]float32 {
+	v := [3]float32{float32(n[0]) / 127, float32(n[1]) / 127, float32(n[2]) / 127}
+	l := float32(math.Sqrt(float64(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])))
+	if l == 0 {
+		return [3]float32{0, 0, 1}
+	}
+	return [3]float32{v[0] / l, v[1] / l, v[2] / l}
+}
+
+func EncodeNormal(n [3]float32) [3]int8 {
+	l := float32(math.Sqrt(float64(n[0]*n[0] + n[1]*n[1] + n[2]*n[2])))
+	if l == 0 || math.IsNaN(float64(l)) || math.IsInf(float64(l), 0) {
+		return [3]int8{0, 0, 127}
+	}
+	return [3]int8{quantizeUnit(n[0] / l), quantizeUnit(n[1] / l), quantizeUnit(n[2] / l)}
+}
+
+func quantizeUnit(v float32) int8 {
+	q := math.Round(float64(v) * 127)
+	if q > 127 {
+		q = 127
+	} else if q < -127 {
+		q = -127
+	}
+	return int8(q)
+}
+
 func (obj *Binobj) SetUVs(vers interface{}) error {
 	switch t := vers.(type) {
 	case []float32:
@@ -927,6 +1047,147 @@ func (obj *Binobj) SetUVs(vers interface{}) error {
 	return nil
 }
 
+func indexBytes(max uint32) uint8 {
+	switch {
+	case max <= math.MaxUint8:
+		return 1
+	case max <= math.MaxUint16:
+		return 2
+	}
+	return 4
+}
+
+// decodeChunk is the number of elements read at once, so a header claiming
+// more data than the stream holds cannot make Decode allocate it up front.
+const decodeChunk = 1 << 16
+
+// readChunked reads size fixed size values, growing the result only as the
+// data arrives. More than MaxInt32 values can only come from a corrupt header.
+func readChunked[T any](rd io.Reader, size uint64) ([]T, error) {
+	if size > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: %d elements", ErrCorruptBuffer, size)
+	}
+	ret := make([]T, 0, min(size, decodeChunk))
+	for uint64(len(ret)) < size {
+		buf := make([]T, min(size-uint64(len(ret)), decodeChunk))
+		err := binary.Read(rd, littleEndian, buf)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, buf...)
+	}
+	return ret, nil
+}
+
+func readIndices(rd io.Reader, width uint8, size uint64) ([]uint32, error) {
+	switch width {
+	case 1:
+		buf, err := readChunked[uint8](rd, size)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]uint32, len(buf))
+		for i := range buf {
+			ret[i] = uint32(buf[i])
+		}
+		return ret, nil
+	case 2:
+		buf, err := readChunked[uint16](rd, size)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]uint32, len(buf))
+		for i := range buf {
+			ret[i] = uint32(buf[i])
+		}
+		return ret, nil
+	case 4:
+		return readChunked[uint32](rd, size)
+	}
+	return nil, fmt.Errorf("unsupported index bytes %d", width)
+}
+
+func writeIndices(wr io.Writer, width uint8, idx []uint32) error {
+	switch width {
+	case 1:
+		buf := make([]uint8, len(idx))
+		for i := range idx {
+			if idx[i] > math.MaxUint8 {
+				return fmt.Errorf("index %d overflow %d bytes", idx[i], width)
+			}
+			buf[i] = uint8(idx[i])
+		}
+		return binary.Write(wr, littleEndian, buf)
+	case 2:
+		buf := make([]uint16, len(idx))
+		for i := range idx {
+			if idx[i] > math.MaxUint16 {
+				return fmt.Errorf("index %d overflow %d bytes", idx[i], width)
+			}
+			buf[i] = uint16(idx[i])
+		}
+		return binary.Write(wr, littleEndian, buf)
+	case 4:
+		return binary.Write(wr, littleEndian, idx)
+	}
+	return fmt.Errorf("unsupported index bytes %d", width)
+}
+
+func readMaterials(rd io.Reader, width uint8, size uint64) ([]uint16, error) {
+	buf, err := readIndices(rd, width, size)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]uint16, len(buf))
+	for i := range buf {
+		if buf[i] > math.MaxUint16 {
+			return nil, fmt.Errorf("material index %d overflow", buf[i])
+		}
+		ret[i] = uint16(buf[i])
+	}
+	return ret, nil
+}
+
+func writeMaterials(wr io.Writer, width uint8, mtls []uint16) error {
+	buf := make([]uint32, len(mtls))
+	for i := range mtls {
+		buf[i] = uint32(mtls[i])
+	}
+	return writeIndices(wr, width, buf)
+}
+
+func readCoords(rd io.Reader, width uint8, size uint64) ([]float32, error) {
+	switch width {
+	case 4:
+		return readChunked[float32](rd, size)
+	case 8:
+		buf, err := readChunked[float64](rd, size)
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]float32, len(buf))
+		for i := range buf {
+			ret[i] = float32(buf[i])
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unsupported coordinate bytes %d", width)
+}
+
+func writeCoords(wr io.Writer, width uint8, coords []float32) error {
+	switch width {
+	case 4:
+		return binary.Write(wr, littleEndian, coords)
+	case 8:
+		buf := make([]float64, len(coords))
+		for i := range coords {
+			buf[i] = float64(coords[i])
+		}
+		return binary.Write(wr, littleEndian, buf)
+	}
+	return fmt.Errorf("unsupported coordinate bytes %d", width)
+}
+
 func handlePadding(n uint32) uint32 {
 	if n%4 > 0 {
 		return 4 - n%4
@@ -934,7 +1195,42 @@ func handlePadding(n uint32) uint32 {
 	return 0
 }
 
-func Decode(rd io.ReadSeeker) (*Binobj, error) {
+type decoder struct {
+	ctx context.Context
+	rd  io.Reader
+	off int64
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	err := d.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	n, err := d.rd.Read(p)
+	d.off += int64(n)
+	return n, err
+}
+
+func (d *decoder) skip(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, d, n)
+	return err
+}
+
+func (d *decoder) align() error {
+	return d.skip(int64(handlePadding(uint32(d.off % 4))))
+}
+
+func Decode(rd io.Reader) (*Binobj, error) {
+	return DecodeContext(context.Background(), rd)
+}
+
+// DecodeContext reads a binary model from a plain stream, consuming the
+// alignment padding itself, and stops early once ctx is done.
+func DecodeContext(ctx context.Context, r io.Reader) (*Binobj, error) {
+	rd := &decoder{ctx: ctx, rd: r}
 	obj := new(Binobj)
 	err := binary.Read(rd, littleEndian, &obj.Header)
 	if err != nil {
@@ -944,8 +1240,16 @@ func Decode(rd io.ReadSeeker) (*Binobj, error) {
 		return nil, errors.New("file not Three.js bin")
 	}
 
-	verbuf := make([]float32, obj.Header.VerticeCount*3)
-	err = binary.Read(rd, littleEndian, verbuf)
+	err = obj.Header.check()
+	if err != nil {
+		return nil, err
+	}
+	err = rd.skip(int64(obj.Header.HeaderBytes - headerSize))
+	if err != nil {
+		return nil, err
+	}
+
+	verbuf, err := readCoords(rd, obj.Header.VertexCoordinateBytes, uint64(obj.Header.VerticeCount)*3)
 	if err != nil {
 		return nil, err
 	}
@@ -954,8 +1258,7 @@ func Decode(rd io.ReadSeeker) (*Binobj, error) {
 		return nil, err
 	}
 
-	norbuf := make([]int8, obj.Header.NormalCount*3)
-	err = binary.Read(rd, littleEndian, norbuf)
+	norbuf, err := readChunked[int8](rd, uint64(obj.Header.NormalCount)*3)
 	if err != nil {
 		return nil, err
 	}
@@ -965,14 +1268,13 @@ func Decode(rd io.ReadSeeker) (*Binobj, error) {
 	}
 
 	if obj.Header.NormalCount > 0 {
-		pading := handlePadding(obj.Header.NormalCount * 3)
-		if pading > 0 {
-			rd.Seek(int64(pading), io.SeekCurrent)
+		err = rd.align()
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	uvbuf := make([]float32, obj.Header.UVCount*2)
-	err = binary.Read(rd, littleEndian, uvbuf)
+	uvbuf, err := readCoords(rd, obj.Header.UVCoordinateBytes, uint64(obj.Header.UVCount)*2)
 	if err != nil {
 		return nil, err
 	}
@@ -982,118 +1284,118 @@ func Decode(rd io.ReadSeeker) (*Binobj, error) {
 	}
 
 	if obj.Header.TriFlatCount > 0 {
-		err = obj.FlatTriangle.decode(rd, obj.Header.TriFlatCount)
+		err = obj.FlatTriangle.decode(rd, obj.Header.TriFlatCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		err = obj.FlatTriangle.decodeMtl(rd, obj.Header.TriFlatCount)
+		err = obj.FlatTriangle.decodeMtl(rd, obj.Header.TriFlatCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		pading := handlePadding(obj.Header.TriFlatCount * 2)
-		if pading > 0 {
-			rd.Seek(int64(pading), io.SeekCurrent)
+		err = rd.align()
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	if obj.Header.TriSmoothCount > 0 {
-		err = obj.SmoothTriangle.decode(rd, obj.Header.TriSmoothCount)
+		err = obj.SmoothTriangle.decode(rd, obj.Header.TriSmoothCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		err = obj.SmoothTriangle.decodeMtl(rd, obj.Header.TriSmoothCount)
+		err = obj.SmoothTriangle.decodeMtl(rd, obj.Header.TriSmoothCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		pading := handlePadding(obj.Header.TriSmoothCount * 2)
-		if pading > 0 {
-			rd.Seek(int64(pading), io.SeekCurrent)
+		err = rd.align()
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	if obj.Header.TriFlatUVCount > 0 {
-		err = obj.FlatUVTriangle.decode(rd, obj.Header.TriFlatUVCount)
+		err = obj.FlatUVTriangle.decode(rd, obj.Header.TriFlatUVCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		err = obj.FlatUVTriangle.decodeMtl(rd, obj.Header.TriFlatUVCount)
+		err = obj.FlatUVTriangle.decodeMtl(rd, obj.Header.TriFlatUVCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		pading := handlePadding(obj.Header.TriFlatUVCount * 2)
-		if pading > 0 {
-			rd.Seek(int64(pading), io.SeekCurrent)
+		err = rd.align()
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	if obj.Header.TriSmoothUVCount > 0 {
-		err = obj.SmoothUVTriangle.decode(rd, obj.Header.TriSmoothUVCount)
+		err = obj.SmoothUVTriangle.decode(rd, obj.Header.TriSmoothUVCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		err = obj.SmoothUVTriangle.decodeMtl(rd, obj.Header.TriSmoothUVCount)
+		err = obj.SmoothUVTriangle.decodeMtl(rd, obj.Header.TriSmoothUVCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		pading := handlePadding(obj.Header.TriSmoothUVCount * 2)
-		if pading > 0 {
-			rd.Seek(int64(pading), io.SeekCurrent)
+		err = rd.align()
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	if obj.Header.QuadFlatCount > 0 {
-		err = obj.FlatQuad.decode(rd, obj.Header.QuadFlatCount)
+		err = obj.FlatQuad.decode(rd, obj.Header.QuadFlatCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		err = obj.FlatQuad.decodeMtl(rd, obj.Header.QuadFlatCount)
+		err = obj.FlatQuad.decodeMtl(rd, obj.Header.QuadFlatCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		pading := handlePadding(obj.Header.QuadFlatCount * 2)
-		if pading > 0 {
-			rd.Seek(int64(pading), io.SeekCurrent)
+		err = rd.align()
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	if obj.Header.QuadSmoothCount > 0 {
-		err = obj.SmoothQuad.decode(rd, obj.Header.QuadSmoothCount)
+		err = obj.SmoothQuad.decode(rd, obj.Header.QuadSmoothCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		err = obj.SmoothQuad.decodeMtl(rd, obj.Header.QuadSmoothCount)
+		err = obj.SmoothQuad.decodeMtl(rd, obj.Header.QuadSmoothCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
 
-		pading := handlePadding(obj.Header.QuadSmoothCount * 2)
-		if pading > 0 {
-			rd.Seek(int64(pading), io.SeekCurrent)
+		err = rd.align()
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	if obj.Header.QuadFlatUVCount > 0 {
-		err = obj.FlatUVQuad.decode(rd, obj.Header.QuadFlatUVCount)
+		err = obj.FlatUVQuad.decode(rd, obj.Header.QuadFlatUVCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		err = obj.FlatUVQuad.decodeMtl(rd, obj.Header.QuadFlatUVCount)
+		err = obj.FlatUVQuad.decodeMtl(rd, obj.Header.QuadFlatUVCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
 
-		pading := handlePadding(obj.Header.QuadFlatUVCount * 2)
-		if pading > 0 {
-			rd.Seek(int64(pading), io.SeekCurrent)
+		err = rd.align()
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	if obj.Header.QuadSmoothUVCount > 0 {
-		err = obj.SmoothUVQuad.decode(rd, obj.Header.QuadSmoothUVCount)
+		err = obj.SmoothUVQuad.decode(rd, obj.Header.QuadSmoothUVCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
-		err = obj.SmoothUVQuad.decodeMtl(rd, obj.Header.QuadSmoothUVCount)
+		err = obj.SmoothUVQuad.decodeMtl(rd, obj.Header.QuadSmoothUVCount, &obj.Header)
 		if err != nil {
 			return nil, err
 		}
@@ -1102,24 +1404,33 @@ func Decode(rd io.ReadSeeker) (*Binobj, error) {
 }
 
 func writePading(wr io.Writer, padding uint32) error {
-	bytes := make([]byte, padding)
-	for i := uint32(0); i < padding; i++ {
-		bytes = append(bytes, '0')
-	}
-	_, err := wr.Write(bytes)
+	_, err := wr.Write(make([]byte, padding))
 	return err
 }
 
 func Encode(wr io.Writer, obj *Binobj) error {
 	if string(obj.Header.Signature[:]) != JS3_BIN_SIGN {
 		obj.Setup()
+	} else {
+		// obj may have been edited since it was decoded
+		obj.Header.counts(obj)
 	}
-	err := binary.Write(wr, littleEndian, obj.Header)
+	err := obj.Header.check()
 	if err != nil {
 		return err
 	}
+	err = binary.Write(wr, littleEndian, obj.Header)
+	if err != nil {
+		return err
+	}
+	if obj.Header.HeaderBytes > headerSize {
+		err = writePading(wr, uint32(obj.Header.HeaderBytes-headerSize))
+		if err != nil {
+			return err
+		}
+	}
 
-	err = binary.Write(wr, littleEndian, obj.GetVectilers())
+	err = writeCoords(wr, obj.Header.VertexCoordinateBytes, obj.GetVectilers())
 	if err != nil {
 		return err
 	}
@@ -1130,7 +1441,7 @@ func Encode(wr io.Writer, obj *Binobj) error {
 	}
 
 	if obj.Header.NormalCount > 0 {
-		pading := handlePadding(obj.Header.NormalCount * 3)
+		pading := handlePadding(obj.Header.NormalCount * 3 * uint32(obj.Header.NormalCoordinateBytes))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1139,18 +1450,22 @@ func Encode(wr io.Writer, obj *Binobj) error {
 		}
 	}
 
-	err = binary.Write(wr, littleEndian, obj.GetUVs())
+	err = writeCoords(wr, obj.Header.UVCoordinateBytes, obj.GetUVs())
 	if err != nil {
 		return err
 	}
 
 	if obj.Header.TriFlatCount > 0 {
-		err = obj.FlatTriangle.encode(wr)
+		err = obj.FlatTriangle.encode(wr, &obj.Header)
+		if err != nil {
+			return err
+		}
+		err = obj.FlatTriangle.encodeMtl(wr, &obj.Header)
 		if err != nil {
 			return err
 		}
 
-		pading := handlePadding(obj.Header.TriFlatCount * 2)
+		pading := handlePadding(obj.Header.TriFlatCount * obj.Header.faceBytes(3, false, false))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1160,12 +1475,16 @@ func Encode(wr io.Writer, obj *Binobj) error {
 	}
 
 	if obj.Header.TriSmoothCount > 0 {
-		err = obj.SmoothTriangle.encode(wr)
+		err = obj.SmoothTriangle.encode(wr, &obj.Header)
+		if err != nil {
+			return err
+		}
+		err = obj.SmoothTriangle.encodeMtl(wr, &obj.Header)
 		if err != nil {
 			return err
 		}
 
-		pading := handlePadding(obj.Header.TriSmoothCount * 2)
+		pading := handlePadding(obj.Header.TriSmoothCount * obj.Header.faceBytes(3, true, false))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1176,12 +1495,16 @@ func Encode(wr io.Writer, obj *Binobj) error {
 
 	if obj.Header.TriFlatUVCount > 0 {
 
-		err = obj.FlatUVTriangle.encode(wr)
+		err = obj.FlatUVTriangle.encode(wr, &obj.Header)
+		if err != nil {
+			return err
+		}
+		err = obj.FlatUVTriangle.encodeMtl(wr, &obj.Header)
 		if err != nil {
 			return err
 		}
 
-		pading := handlePadding(obj.Header.TriFlatUVCount * 2)
+		pading := handlePadding(obj.Header.TriFlatUVCount * obj.Header.faceBytes(3, false, true))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1192,12 +1515,16 @@ func Encode(wr io.Writer, obj *Binobj) error {
 
 	if obj.Header.TriSmoothUVCount > 0 {
 
-		err = obj.SmoothUVTriangle.encode(wr)
+		err = obj.SmoothUVTriangle.encode(wr, &obj.Header)
+		if err != nil {
+			return err
+		}
+		err = obj.SmoothUVTriangle.encodeMtl(wr, &obj.Header)
 		if err != nil {
 			return err
 		}
 
-		pading := handlePadding(obj.Header.TriSmoothUVCount * 2)
+		pading := handlePadding(obj.Header.TriSmoothUVCount * obj.Header.faceBytes(3, true, true))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1208,12 +1535,16 @@ func Encode(wr io.Writer, obj *Binobj) error {
 
 	if obj.Header.QuadFlatCount > 0 {
 
-		err = obj.FlatQuad.encode(wr)
+		err = obj.FlatQuad.encode(wr, &obj.Header)
+		if err != nil {
+			return err
+		}
+		err = obj.FlatQuad.encodeMtl(wr, &obj.Header)
 		if err != nil {
 			return err
 		}
 
-		pading := handlePadding(obj.Header.QuadFlatCount * 2)
+		pading := handlePadding(obj.Header.QuadFlatCount * obj.Header.faceBytes(4, false, false))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1224,12 +1555,16 @@ func Encode(wr io.Writer, obj *Binobj) error {
 
 	if obj.Header.QuadSmoothCount > 0 {
 
-		err = obj.SmoothQuad.encode(wr)
+		err = obj.SmoothQuad.encode(wr, &obj.Header)
+		if err != nil {
+			return err
+		}
+		err = obj.SmoothQuad.encodeMtl(wr, &obj.Header)
 		if err != nil {
 			return err
 		}
 
-		pading := handlePadding(obj.Header.QuadSmoothCount * 2)
+		pading := handlePadding(obj.Header.QuadSmoothCount * obj.Header.faceBytes(4, true, false))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1240,12 +1575,16 @@ func Encode(wr io.Writer, obj *Binobj) error {
 
 	if obj.Header.QuadFlatUVCount > 0 {
 
-		err = obj.FlatUVQuad.encode(wr)
+		err = obj.FlatUVQuad.encode(wr, &obj.Header)
+		if err != nil {
+			return err
+		}
+		err = obj.FlatUVQuad.encodeMtl(wr, &obj.Header)
 		if err != nil {
 			return err
 		}
 
-		pading := handlePadding(obj.Header.QuadFlatUVCount * 2)
+		pading := handlePadding(obj.Header.QuadFlatUVCount * obj.Header.faceBytes(4, false, true))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1256,12 +1595,16 @@ func Encode(wr io.Writer, obj *Binobj) error {
 
 	if obj.Header.QuadSmoothUVCount > 0 {
 
-		err = obj.SmoothUVQuad.encode(wr)
+		err = obj.SmoothUVQuad.encode(wr, &obj.Header)
+		if err != nil {
+			return err
+		}
+		err = obj.SmoothUVQuad.encodeMtl(wr, &obj.Header)
 		if err != nil {
 			return err
 		}
 
-		pading := handlePadding(obj.Header.QuadSmoothUVCount * 2)
+		pading := handlePadding(obj.Header.QuadSmoothUVCount * obj.Header.faceBytes(4, true, true))
 		if pading > 0 {
 			err = writePading(wr, pading)
 			if err != nil {
@@ -1285,6 +1628,21 @@ type Metadata struct {
 	Materials    uint32  `json:"materials"`
 }
 
+func newMetadata(obj *Binobj, materials int) Metadata {
+	h := &obj.Header
+	return Metadata{
+		Version:      3,
+		GeneratedBy:  "go-3jsbin",
+		VerticeCount: h.VerticeCount,
+		FaceCount: h.TriFlatCount + h.TriSmoothCount + h.TriFlatUVCount + h.TriSmoothUVCount +
+			h.QuadFlatCount + h.QuadSmoothCount + h.QuadFlatUVCount + h.QuadSmoothUVCount,
+		NormalCount: h.NormalCount,
+		ColorsCount: uint32(len(obj.Colors)),
+		UVCount:     h.UVCount,
+		Materials:   uint32(materials),
+	}
+}
+
 type ThreeJSObj struct {
 	Metadata  Metadata   `json:"metadata"`
 	Materials []Material `json:"materials"`
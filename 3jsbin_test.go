@@ -2,21 +2,29 @@ package bin
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	mst "github.com/flywave/go-mst"
 )
 
 func TestJsLoadFiles(t *testing.T) {
 	f, err := os.Open("../../tests/binary/palm.js")
-	defer f.Close()
-
 	if err != nil {
-		t.Error("error")
+		t.Skip(err)
 	}
+	defer f.Close()
 	obj, err := ThreeJSObjFromJson(f)
 	if err != nil {
 		t.Error("error")
@@ -28,11 +36,10 @@ func TestJsLoadFiles(t *testing.T) {
 
 func TestBinLoadFiles(t *testing.T) {
 	f, err := os.Open("../../tests/binary/palm.bin")
-	defer f.Close()
-
 	if err != nil {
-		t.Error("error")
+		t.Skip(err)
 	}
+	defer f.Close()
 
 	obj, err := Decode(f)
 	if err != nil {
@@ -43,61 +50,309 @@ func TestBinLoadFiles(t *testing.T) {
 	}
 }
 
-const absPath = "/home/hj/workspace/GISCore/build/public/Resources/"
-
-func TestToMst(t *testing.T) {
-	dirs := []string{"model/thsk/thsk_sw_xj"} //"anchormodel"
-	for _, d := range dirs {
-		dr := absPath + d
-		fs, _ := readDir(dr, dr, []string{".json"})
-		for _, f := range fs {
-			fpath := dr + f
-			mstPh := strings.Replace(fpath, ".json", ".mst", 1)
-			glbPh := strings.Replace(mstPh, ".mst", ".glb", 1)
-			// if info, err := os.Stat(mstPh); err == nil {
-			// 	t := time.Date(2021, time.November, 16, 12, 40, 0, 0, time.UTC)
-			// 	if info.ModTime().After(t) {
-			// 		continue
-			// 	}
-			// }
-			mh, _ := ThreejsBin2Mst(fpath)
-			for _, nd := range mh.Nodes {
-				nd.ReComputeNormal()
-			}
-			doc := mst.CreateDoc()
-			mst.BuildGltf(doc, mh, false)
-			bt, _ := mst.GetGltfBinary(doc, 8)
-			ioutil.WriteFile(glbPh, bt, os.ModePerm)
-
-			wt := bytes.NewBuffer([]byte{})
-			mst.MeshMarshal(wt, mh)
-			ioutil.WriteFile(mstPh, wt.Bytes(), os.ModePerm)
-		}
-	}
-}
-
 func TestGltf(t *testing.T) {
-	mesh, _ := ThreejsBin2Mst("/home/hj/workspace/GISCore/build/public/Resources/model/public/HHRQQiTiWoLunLiuLiangJi/HHRQQiTiWoLunLiuLiangJi.json")
+	mesh, err := ThreejsBin2Mst("/home/hj/workspace/GISCore/build/public/Resources/model/public/HHRQQiTiWoLunLiuLiangJi/HHRQQiTiWoLunLiuLiangJi.json")
+	if err != nil {
+		t.Skip(err)
+	}
 	doc := mst.CreateDoc()
-	mst.BuildGltf(doc, mesh, false)
+	mst.BuildGltf(doc, mesh, false, false)
 	bt, _ := mst.GetGltfBinary(doc, 8)
 	ioutil.WriteFile("/home/hj/workspace/GISCore/build/public/Resources/model/public/HHRQQiTiWoLunLiuLiangJi/HHRQQiTiWoLunLiuLiangJi.glb", bt, os.ModePerm)
 }
 
 func TestGltf2(t *testing.T) {
-	mh, _ := ThreejsBin2Mst("/home/hj/workspace/GISCore/build/public/Resources/model/zbrl/ZBRL_BY/ZBRL_BY_1.json")
+	mh, err := ThreejsBin2Mst("/home/hj/workspace/GISCore/build/public/Resources/model/zbrl/ZBRL_BY/ZBRL_BY_1.json")
+	if err != nil {
+		t.Skip(err)
+	}
 
 	doc := mst.CreateDoc()
-	mst.BuildGltf(doc, mh, false)
+	mst.BuildGltf(doc, mh, false, false)
 	bt, _ := mst.GetGltfBinary(doc, 8)
 	ioutil.WriteFile("/home/hj/workspace/GISCore/build/public/Resources/model/zbrl/ZBRL_BY/ZBRL_BY_1.glb", bt, os.ModePerm)
 }
 
 func TestBin2(t *testing.T) {
-	mh, _ := ThreejsBin2Mst("/home/hj/workspace/GISCore/build/public/Resources/anchormodel/public/psqitong/psqitong.json")
+	mh, err := ThreejsBin2Mst("/home/hj/workspace/GISCore/build/public/Resources/anchormodel/public/psqitong/psqitong.json")
+	if err != nil {
+		t.Skip(err)
+	}
 	doc := mst.CreateDoc()
-	mst.BuildGltf(doc, mh, false)
+	mst.BuildGltf(doc, mh, false, false)
 	bt, _ := mst.GetGltfBinary(doc, 8)
 	ioutil.WriteFile("/home/hj/workspace/GISCore/build/public/Resources/anchormodel/public/psqitong/psqitong.glb", bt, os.ModePerm)
 
 }
+
+func TestCompactIndexBytes(t *testing.T) {
+	obj := &Binobj{}
+	obj.SetVectilers([]float32{0, 0, 0, 1, 0, 0, 1, 1, 0, 0, 1, 0})
+	obj.FlatTriangle.SetVertices([]uint32{0, 1, 2})
+	obj.FlatTriangle.SetMaterial([]uint16{0})
+	obj.FlatQuad.SetVertices([]uint32{0, 1, 2, 3})
+	obj.FlatQuad.SetMaterial([]uint16{1})
+	obj.SetupCompact()
+
+	if obj.Header.VertexIndexBytes != 1 || obj.Header.MaterialIndexBytes != 1 {
+		t.Fatalf("unexpected index bytes %d %d", obj.Header.VertexIndexBytes, obj.Header.MaterialIndexBytes)
+	}
+
+	wr := bytes.NewBuffer([]byte{})
+	if err := Encode(wr, obj); err != nil {
+		t.Fatal(err)
+	}
+	ret, err := Decode(bytes.NewReader(wr.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Header.VertexIndexBytes != 1 {
+		t.Errorf("header index bytes not kept")
+	}
+	if ret.FlatTriangle.Vertices[0] != [3]uint32{0, 1, 2} || ret.FlatTriangle.Material[0] != 0 {
+		t.Errorf("bad triangle %v", ret.FlatTriangle)
+	}
+	if ret.FlatQuad.Vertices[0] != [4]uint32{0, 1, 2, 3} || ret.FlatQuad.Material[0] != 1 {
+		t.Errorf("bad quad %v", ret.FlatQuad)
+	}
+}
+
+func TestDecodeShortIndices(t *testing.T) {
+	h := Header{}
+	h.SetDefault()
+	h.VertexIndexBytes = 2
+	h.VerticeCount = 3
+	h.TriFlatCount = 1
+
+	wr := bytes.NewBuffer([]byte{})
+	binary.Write(wr, littleEndian, h)
+	binary.Write(wr, littleEndian, []float32{0, 0, 0, 1, 0, 0, 0, 1, 0})
+	binary.Write(wr, littleEndian, []uint16{2, 1, 0})
+	binary.Write(wr, littleEndian, []uint16{5})
+
+	obj, err := Decode(bytes.NewReader(wr.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.FlatTriangle.Vertices[0] != [3]uint32{2, 1, 0} || obj.FlatTriangle.Material[0] != 5 {
+		t.Errorf("bad triangle %v", obj.FlatTriangle)
+	}
+}
+
+func TestNormalQuantization(t *testing.T) {
+	n := DecodeNormal([3]int8{90, 0, 90})
+	if math.Abs(float64(n[0])-math.Sqrt2/2) > 1e-6 || n[1] != 0 || math.Abs(float64(n[2])-math.Sqrt2/2) > 1e-6 {
+		t.Errorf("bad decoded normal %v", n)
+	}
+	if DecodeNormal([3]int8{}) != [3]float32{0, 0, 1} {
+		t.Errorf("zero normal not mapped to +Z")
+	}
+
+	obj := &Binobj{}
+	obj.SetNormals([][3]float32{{0, 2, 0}, {0.6, -0.8, 0}})
+	if obj.Normals[0] != [3]int8{0, 127, 0} || obj.Normals[1] != [3]int8{76, -102, 0} {
+		t.Errorf("bad encoded normals %v", obj.Normals)
+	}
+	dn := obj.GetDecodedNormals()
+	if math.Abs(float64(dn[1][0])-0.6) > 0.01 || math.Abs(float64(dn[1][1])+0.8) > 0.01 {
+		t.Errorf("normal round trip drifted %v", dn[1])
+	}
+}
+
+var update = flag.Bool("update", false, "update golden files")
+
+func testBinobj(buckets uint8) *Binobj {
+	obj := &Binobj{}
+	obj.SetVectilers([]float32{0, 0, 0, 1, 0, 0, 1, 1, 0, 0, 1, 0, 0, 0, 1})
+	obj.SetNormals([]int8{0, 0, 127, 0, 127, 0, 127, 0, 0})
+	obj.SetUVs([]float32{0, 0, 1, 0, 1, 1})
+
+	if buckets&(1<<BucketFlatTriangle) != 0 {
+		obj.FlatTriangle.SetVertices([]uint32{0, 1, 2})
+		obj.FlatTriangle.SetMaterial([]uint16{0})
+	}
+	if buckets&(1<<BucketSmoothTriangle) != 0 {
+		obj.SmoothTriangle.SetVertices([]uint32{0, 2, 3})
+		obj.SmoothTriangle.SetNormals([]uint32{0, 1, 2})
+		obj.SmoothTriangle.SetMaterial([]uint16{1})
+	}
+	if buckets&(1<<BucketFlatUVTriangle) != 0 {
+		obj.FlatUVTriangle.SetVertices([]uint32{1, 2, 4})
+		obj.FlatUVTriangle.SetUVs([]uint32{0, 1, 2})
+		obj.FlatUVTriangle.SetMaterial([]uint16{2})
+	}
+	if buckets&(1<<BucketSmoothUVTriangle) != 0 {
+		obj.SmoothUVTriangle.SetVertices([]uint32{2, 3, 4})
+		obj.SmoothUVTriangle.SetNormals([]uint32{2, 1, 0})
+		obj.SmoothUVTriangle.SetUVs([]uint32{2, 1, 0})
+		obj.SmoothUVTriangle.SetMaterial([]uint16{3})
+	}
+	if buckets&(1<<BucketFlatQuad) != 0 {
+		obj.FlatQuad.SetVertices([]uint32{0, 1, 2, 3})
+		obj.FlatQuad.SetMaterial([]uint16{4})
+	}
+	if buckets&(1<<BucketSmoothQuad) != 0 {
+		obj.SmoothQuad.SetVertices([]uint32{1, 2, 3, 4})
+		obj.SmoothQuad.SetNormals([]uint32{0, 1, 2, 0})
+		obj.SmoothQuad.SetMaterial([]uint16{5})
+	}
+	if buckets&(1<<BucketFlatUVQuad) != 0 {
+		obj.FlatUVQuad.SetVertices([]uint32{4, 3, 2, 1})
+		obj.FlatUVQuad.SetUVs([]uint32{0, 1, 2, 0})
+		obj.FlatUVQuad.SetMaterial([]uint16{6})
+	}
+	if buckets&(1<<BucketSmoothUVQuad) != 0 {
+		obj.SmoothUVQuad.SetVertices([]uint32{0, 2, 4, 1})
+		obj.SmoothUVQuad.SetNormals([]uint32{1, 1, 2, 2})
+		obj.SmoothUVQuad.SetUVs([]uint32{2, 2, 1, 1})
+		obj.SmoothUVQuad.SetMaterial([]uint16{7})
+	}
+	return obj
+}
+
+func encodeBytes(t *testing.T, obj *Binobj) []byte {
+	wr := bytes.NewBuffer([]byte{})
+	if err := Encode(wr, obj); err != nil {
+		t.Fatal(err)
+	}
+	return wr.Bytes()
+}
+
+func TestRoundTripAllBuckets(t *testing.T) {
+	for mask := 0; mask < 256; mask++ {
+		for _, compact := range []bool{false, true} {
+			obj := testBinobj(uint8(mask))
+			if compact {
+				obj.SetupCompact()
+			}
+			buf := encodeBytes(t, obj)
+			if len(buf)%4 != 0 {
+				t.Errorf("buckets %08b: output not 4 byte aligned (%d)", mask, len(buf))
+			}
+			ret, err := Decode(bytes.NewReader(buf))
+			if err != nil {
+				t.Fatalf("buckets %08b: %v", mask, err)
+			}
+			if !bytes.Equal(encodeBytes(t, ret), buf) {
+				t.Errorf("buckets %08b compact %v: round trip differs", mask, compact)
+			}
+			if len(ret.ValidateMaterials(8)) != 0 {
+				t.Errorf("buckets %08b: %v", mask, ret.ValidateMaterials(8))
+			}
+		}
+	}
+}
+
+func TestEncodeEdited(t *testing.T) {
+	obj := testBinobj(1<<BucketFlatTriangle | 1<<BucketSmoothQuad)
+	obj.SetupCompact()
+	ret, err := Decode(bytes.NewReader(encodeBytes(t, obj)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret.FlatTriangle.Vertices = append(ret.FlatTriangle.Vertices, [3]uint32{3, 4, 0})
+	ret.FlatTriangle.Material = append(ret.FlatTriangle.Material, 1)
+	ret.SmoothQuad.Vertices, ret.SmoothQuad.Normals, ret.SmoothQuad.Material = nil, nil, nil
+
+	ret, err = Decode(bytes.NewReader(encodeBytes(t, ret)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Header.TriFlatCount != 2 || ret.Header.QuadSmoothCount != 0 || ret.Header.VertexIndexBytes != 1 {
+		t.Errorf("stale header %+v", ret.Header)
+	}
+	if ret.FlatTriangle.Vertices[1] != [3]uint32{3, 4, 0} {
+		t.Errorf("appended face lost %v", ret.FlatTriangle.Vertices)
+	}
+}
+
+func TestDecodeHugeCounts(t *testing.T) {
+	for _, n := range []uint32{math.MaxUint32, 100 << 20} {
+		obj := testBinobj(0)
+		obj.Setup()
+		obj.Header.VerticeCount = n
+		buf := &bytes.Buffer{}
+		if err := binary.Write(buf, littleEndian, obj.Header); err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(make([]byte, 64))
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := Decode(buf)
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%d vertices: short body accepted", n)
+		}
+		if n == math.MaxUint32 && !errors.Is(err, ErrCorruptBuffer) {
+			t.Errorf("%d vertices: %v", n, err)
+		}
+		if grown := after.TotalAlloc - before.TotalAlloc; grown > 16<<20 {
+			t.Errorf("%d vertices: allocated %d bytes", n, grown)
+		}
+	}
+}
+
+func TestGoldenFiles(t *testing.T) {
+	cases := map[string]*Binobj{}
+	for b := BucketFlatTriangle; b <= BucketSmoothUVQuad; b++ {
+		cases[strings.ToLower(b.String())] = testBinobj(1 << b)
+	}
+	cases["all"] = testBinobj(0xff)
+	compact := testBinobj(0xff)
+	compact.SetupCompact()
+	cases["all_compact"] = compact
+
+	for name, obj := range cases {
+		golden := filepath.Join("testdata", name+".bin")
+		buf := encodeBytes(t, obj)
+		if *update {
+			if err := os.WriteFile(golden, buf, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, want) {
+			t.Errorf("%s: encode differs from golden file", name)
+		}
+		ret, err := Decode(bytes.NewReader(want))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(encodeBytes(t, ret), want) {
+			t.Errorf("%s: decode and encode differs from golden file", name)
+		}
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	buf, err := os.ReadFile(filepath.Join("testdata", "all.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zb := bytes.NewBuffer([]byte{})
+	zw := gzip.NewWriter(zb)
+	zw.Write(buf)
+	zw.Close()
+
+	zr, err := gzip.NewReader(zb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := Decode(iotest.OneByteReader(zr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encodeBytes(t, obj), buf) {
+		t.Errorf("streamed decode differs")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DecodeContext(ctx, bytes.NewReader(buf)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancel, got %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package bin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	mst "github.com/flywave/go-mst"
+)
+
+// BatchFunc converts the file in to out and returns the warnings of the
+// conversion. out is empty when the batch has no OutExt. Nothing should be
+// written once ctx is cancelled.
+type BatchFunc func(ctx context.Context, in, out string) ([]error, error)
+
+type BatchOptions struct {
+	// Exts are the extensions of the files converted, ".json" when empty.
+	Exts []string
+	// OutExt replaces the extension of every input to name its output.
+	// Without it nothing is written and nothing is skipped.
+	OutExt string
+	// OutDir holds the outputs, in the same tree as below the root. Outputs
+	// are written next to their inputs when it is empty.
+	OutDir string
+	// Workers is the number of files converted at once, the number of CPUs
+	// when zero.
+	Workers int
+	// KeepExisting skips inputs whose output exists, Incremental only
+	// those whose output is not older than the input and the files listed
+	// by Inputs.
+	KeepExisting bool
+	Incremental  bool
+	// Inputs lists the files besides in that its output is made from.
+	// ModelInputs is used for .json inputs when it is nil; other inputs
+	// only count themselves.
+	Inputs func(in string) ([]string, error)
+	// Progress is called as each file is done, never concurrently.
+	Progress func(BatchResult)
+}
+
+type BatchResult struct {
+	// Path is the input and Rel its path below the root.
+	Path     string
+	Rel      string
+	Output   string
+	Skipped  bool
+	Warnings []error
+	Err      error
+	Duration time.Duration
+}
+
+// Batch runs conv over root, a file or a directory searched like readDir,
+// with a pool of workers. Results are in the order of the inputs. When ctx
+// is cancelled files not yet started are left out and ctx.Err() returned.
+func Batch(ctx context.Context, root string, opts *BatchOptions, conv BatchFunc) ([]BatchResult, error) {
+	if opts == nil {
+		opts = &BatchOptions{}
+	}
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	var rels []string
+	if st.IsDir() {
+		exts := opts.Exts
+		if len(exts) == 0 {
+			exts = []string{".json"}
+		}
+		files, err := readDir(root, root, exts)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			rels = append(rels, strings.TrimPrefix(f, string(filepath.Separator)))
+		}
+	} else {
+		rels = []string{filepath.Base(root)}
+		root = filepath.Dir(root)
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	results := make([]BatchResult, len(rels))
+	done := make([]bool, len(rels))
+	jobs := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := batchFile(ctx, root, rels[i], opts, conv)
+				mu.Lock()
+				results[i], done[i] = r, true
+				if opts.Progress != nil {
+					opts.Progress(r)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+dispatch:
+	for i := range rels {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		var ret []BatchResult
+		for i, r := range results {
+			if done[i] {
+				ret = append(ret, r)
+			}
+		}
+		return ret, err
+	}
+	return results, nil
+}
+
+func batchFile(ctx context.Context, root, rel string, opts *BatchOptions, conv BatchFunc) (r BatchResult) {
+	r = BatchResult{Path: filepath.Join(root, rel), Rel: rel}
+	start := time.Now()
+	defer func() { r.Duration = time.Since(start) }()
+
+	if opts.OutExt != "" {
+		base := strings.TrimSuffix(rel, filepath.Ext(rel)) + opts.OutExt
+		r.Output = filepath.Join(root, base)
+		if opts.OutDir != "" {
+			r.Output = filepath.Join(opts.OutDir, base)
+		}
+		r.Skipped, r.Err = skipOutput(r.Path, r.Output, opts)
+		if r.Skipped || r.Err != nil {
+			return r
+		}
+		if r.Err = os.MkdirAll(filepath.Dir(r.Output), os.ModePerm); r.Err != nil {
+			return r
+		}
+	}
+	r.Warnings, r.Err = conv(ctx, r.Path, r.Output)
+	return r
+}
+
+func skipOutput(in, out string, opts *BatchOptions) (bool, error) {
+	if !opts.KeepExisting && !opts.Incremental {
+		return false, nil
+	}
+	ost, err := os.Stat(out)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil || opts.KeepExisting {
+		return err == nil, err
+	}
+	inputs := opts.Inputs
+	if inputs == nil && strings.EqualFold(filepath.Ext(in), ".json") {
+		inputs = ModelInputs
+	}
+	files := []string{in}
+	if inputs != nil {
+		more, err := inputs(in)
+		if err != nil {
+			return false, err
+		}
+		files = append(files, more...)
+	}
+	for i, f := range files {
+		ist, err := os.Stat(f)
+		if i > 0 && errors.Is(err, fs.ErrNotExist) {
+			// the conversion reports it
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if ist.ModTime().After(ost.ModTime()) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ModelInputs lists the buffer and textures the model json at fpath refers
+// to, resolved the way Convert does.
+func ModelInputs(fpath string) ([]string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var md struct {
+		BinBuffer string     `json:"buffers"`
+		Materials []Material `json:"materials"`
+	}
+	if err := json.NewDecoder(f).Decode(&md); err != nil {
+		return nil, fmt.Errorf("%s: %w", fpath, err)
+	}
+	dir := filepath.Dir(fpath)
+	var ret []string
+	add := func(name string) {
+		if name != "" {
+			ret = append(ret, filepath.FromSlash(resolvePath(filepath.ToSlash(dir), name)))
+		}
+	}
+	add(md.BinBuffer)
+	for i := range md.Materials {
+		for _, mp := range md.Materials[i].maps() {
+			add(*mp)
+		}
+	}
+	return ret, nil
+}
+
+// replaceFile has write create a temporary file next to fpath and renames it
+// to fpath once complete, so an interrupted write never leaves a truncated
+// output that looks up to date.
+func replaceFile(fpath string, write func(tmp string) error) error {
+	dir, name := filepath.Split(fpath)
+	f, err := os.CreateTemp(dir, "."+name+"-*"+filepath.Ext(name))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	err = write(tmp)
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fpath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// MstBatch converts model json files to .mst, with the anchors beside each
+// in the file named by AnchorsPath.
+func MstBatch(opts *ConvertOptions) BatchFunc {
+	return func(ctx context.Context, in, out string) ([]error, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fsys, name, err := RootFS(in)
+		if err != nil {
+			return nil, err
+		}
+		res, err := Convert(fsys, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		mst.MeshMarshal(buf, res.Mesh)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		err = replaceFile(out, func(tmp string) error {
+			return os.WriteFile(tmp, buf.Bytes(), 0644)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res.Warnings, WriteAnchors(out, res.Anchors)
+	}
+}
+
+// GltfBatch converts model json files to glTF, binary if out ends in .glb.
+func GltfBatch(opts *ConvertOptions) BatchFunc {
+	return func(ctx context.Context, in, out string) ([]error, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fsys, name, err := RootFS(in)
+		if err != nil {
+			return nil, err
+		}
+		res, err := ConvertGltf(fsys, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return res.Warnings, replaceFile(out, func(tmp string) error {
+			return WriteGltf(res.Doc, tmp)
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package bin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"a/one.json":   cubeFaceJson,
+		"a/b/two.json": colorFaceJson,
+		"bad.json":     `{"buffers": "missing.bin"}`,
+		"skip.txt":     "not a model",
+	} {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fpath, []byte(data), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(dir, "out")
+	opts := &BatchOptions{OutExt: ".mst", OutDir: out, Workers: 2, Incremental: true}
+	results, err := Batch(context.Background(), dir, opts, MstBatch(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			continue
+		}
+		if _, err := os.Stat(r.Output); err != nil || r.Duration <= 0 {
+			t.Errorf("%s not converted: %v", r.Rel, err)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected the model without buffer to fail, got %d failures", failed)
+	}
+	if _, err := os.Stat(filepath.Join(out, "a", "b", "two.mst")); err != nil {
+		t.Error(err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "a", "one.json"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	results, err = Batch(context.Background(), dir, opts, MstBatch(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if want := r.Rel == "bad.json" || r.Rel == filepath.Join("a", "one.json"); r.Skipped == want {
+			t.Errorf("%s: skipped %v", r.Rel, r.Skipped)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = Batch(ctx, dir, opts, MstBatch(nil))
+	if err != context.Canceled || len(results) != 0 {
+		t.Errorf("cancel ignored: %v %d", err, len(results))
+	}
+
+	for _, conv := range []BatchFunc{MstBatch(nil), GltfBatch(nil)} {
+		fpath := filepath.Join(out, "cancelled")
+		if _, err := conv(ctx, filepath.Join(dir, "a", "one.json"), fpath); err != context.Canceled {
+			t.Errorf("cancelled conversion returned %v", err)
+		}
+		if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+			t.Errorf("output written after cancel: %v", err)
+		}
+	}
+}
+
+func TestMstBatchAnchors(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "one.json")
+	js := strings.Replace(cubeFaceJson, "{", `{"topology": {"offset": [1, 0, 0], "anchors": [{"normal": [0, 0, 1], "center": [0, 0, 0], "unit": 1, "name": "a"}]},`, 1)
+	if err := os.WriteFile(in, []byte(js), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "one.mst")
+	if _, err := MstBatch(nil)(context.Background(), in, out); err != nil {
+		t.Fatal(err)
+	}
+	anchors, err := ReadAnchors(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anchors) != 1 || anchors[0].Name != "a" || anchors[0].Center[0] != 1 {
+		t.Errorf("bad anchors %+v", anchors)
+	}
+
+	if err := os.WriteFile(in, []byte(cubeFaceJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MstBatch(nil)(context.Background(), in, out); err != nil {
+		t.Fatal(err)
+	}
+	if anchors, err := ReadAnchors(out); err != nil || anchors != nil {
+		t.Errorf("stale anchors kept %v %v", anchors, err)
+	}
+}
+
+func TestBatchIncrementalInputs(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "model.json")
+	ts := &ThreeJSObj{Materials: []Material{defaultMaterial(0)}, Topology: identityTopology()}
+	if err := WriteThreejsBin(ts, testBinobj(1<<BucketFlatTriangle), fpath); err != nil {
+		t.Fatal(err)
+	}
+	opts := &BatchOptions{OutExt: ".mst", Incremental: true}
+	if _, err := Batch(context.Background(), dir, opts, MstBatch(nil)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "model.bin"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	results, err := Batch(context.Background(), dir, opts, MstBatch(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Skipped || results[0].Err != nil {
+		t.Errorf("newer buffer ignored %+v", results)
+	}
+}
@@ -0,0 +1,55 @@
+package bin
+
+import (
+	"math"
+
+	dvec3 "github.com/flywave/go3d/float64/vec3"
+)
+
+// Box is an axis aligned bounding box.
+type Box struct {
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+}
+
+type Sphere struct {
+	Center [3]float64 `json:"center"`
+	Radius float64    `json:"radius"`
+}
+
+// Bounds returns the box and sphere around all vertices of obj, moved by
+// the transform of tp first unless tp is nil. The sphere is centered on the
+// box, which is not the tightest sphere but cheap and stable. A model
+// without vertices has zero bounds.
+func (obj *Binobj) Bounds(tp *Topology) (Box, Sphere) {
+	if len(obj.Vectilers) == 0 {
+		return Box{}, Sphere{}
+	}
+	pts := make([]dvec3.T, len(obj.Vectilers))
+	for i, v := range obj.Vectilers {
+		pts[i] = dvec3.T{float64(v[0]), float64(v[1]), float64(v[2])}
+	}
+	if tp != nil {
+		mat := tp.Transform()
+		for i := range pts {
+			pts[i] = mat.MulVec3(&pts[i])
+		}
+	}
+
+	box := Box{Min: pts[0], Max: pts[0]}
+	for _, p := range pts[1:] {
+		for k := range p {
+			box.Min[k] = math.Min(box.Min[k], p[k])
+			box.Max[k] = math.Max(box.Max[k], p[k])
+		}
+	}
+	sp := Sphere{}
+	for k := range sp.Center {
+		sp.Center[k] = (box.Min[k] + box.Max[k]) / 2
+	}
+	c := dvec3.T(sp.Center)
+	for i := range pts {
+		sp.Radius = math.Max(sp.Radius, dvec3.Distance(&pts[i], &c))
+	}
+	return box, sp
+}
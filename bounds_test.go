@@ -0,0 +1,48 @@
+package bin
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/flywave/gltf"
+)
+
+func TestBounds(t *testing.T) {
+	ts, obj, err := ThreeJSModelFromJson(strings.NewReader(cubeFaceJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, sp := obj.Bounds(nil)
+	if box.Min != [3]float64{0, 0, 0} || box.Max != [3]float64{1, 1, 0} || math.Abs(sp.Radius-math.Sqrt(0.5)) > 1e-9 {
+		t.Errorf("bad local bounds %v %v", box, sp)
+	}
+
+	ts.Topology = Topology{Scale: 2, Offset: []float64{1, 0, 0}}
+	box, sp = obj.Bounds(&ts.Topology)
+	if box.Min != [3]float64{1, 0, 0} || box.Max != [3]float64{3, 2, 0} || sp.Center != [3]float64{2, 1, 0} || math.Abs(sp.Radius-math.Sqrt2) > 1e-9 {
+		t.Errorf("bad placed bounds %v %v", box, sp)
+	}
+
+	js := strings.Replace(cubeFaceJson, "{", `{"topology": {"scale": 2, "offset": [1, 0, 0]},`, 1)
+	res, err := Convert(fstest.MapFS{"model.json": &fstest.MapFile{Data: []byte(js)}}, "model.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Bounds != box || res.Sphere != sp {
+		t.Errorf("bounds not in result %v %v", res.Bounds, res.Sphere)
+	}
+
+	res, err = ThreejsToGltf(ts, obj, nil, "model.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := res.Doc.Accessors[res.Doc.Meshes[0].Primitives[0].Attributes[gltf.POSITION]]
+	if len(pos.Min) != 3 || pos.Max[0] != 1 {
+		t.Errorf("accessor bounds missing %v %v", pos.Min, pos.Max)
+	}
+	if ex := res.Doc.Nodes[0].Extras.(map[string]interface{}); ex["bounds"] != box {
+		t.Errorf("node bounds missing %v", ex)
+	}
+}
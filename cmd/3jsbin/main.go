@@ -0,0 +1,274 @@
+// Command 3jsbin inspects and converts three.js binary models.
+//
+//	3jsbin <command> [flags] <file or directory>...
+//
+// Directories are searched recursively for the files the command reads.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bin "github.com/flywave/go-3jsbin"
+)
+
+type command struct {
+	name  string
+	usage string
+	// in is the extension of the files the command reads, out the one it
+	// writes; commands without out only report.
+	in, out string
+	// lenient commands run Convert and take -lenient
+	lenient bool
+	run     func(c *config) bin.BatchFunc
+}
+
+type config struct {
+	outDir    string
+	overwrite bool
+	newer     bool
+	lenient   bool
+	gltf      bool
+	workers   int
+}
+
+var commands = []*command{
+	{name: "info", usage: "print the model header and materials", in: ".json", run: report(info)},
+	{name: "validate", usage: "check face indices and positions", in: ".json", run: report(validate)},
+	{name: "to-gltf", usage: "convert to .glb, or .gltf with -gltf", in: ".json", out: ".glb", lenient: true, run: func(c *config) bin.BatchFunc { return bin.GltfBatch(c.options()) }},
+	{name: "to-mst", usage: "convert to .mst, anchors go to .anchors.json", in: ".json", out: ".mst", lenient: true, run: func(c *config) bin.BatchFunc { return bin.MstBatch(c.options()) }},
+	{name: "to-obj", usage: "convert to .obj and .mtl", in: ".json", out: ".obj", run: report(toObj)},
+	{name: "from-obj", usage: "convert .obj to a model json and .bin", in: ".obj", out: ".json", run: fromObj},
+}
+
+// report adapts the commands that have no warnings to report.
+func report(fn func(c *config, in, out string) error) func(c *config) bin.BatchFunc {
+	return func(c *config) bin.BatchFunc {
+		return func(ctx context.Context, in, out string) ([]error, error) {
+			return nil, fn(c, in, out)
+		}
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	if err := run(os.Args[1], os.Args[2:]); err != nil {
+		if !errors.Is(err, errFailed) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+var errFailed = errors.New("some files failed")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: 3jsbin <command> [flags] <file or directory>...\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+func run(name string, args []string) error {
+	var cmd *command
+	for _, c := range commands {
+		if c.name == name {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		usage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	c := &config{}
+	fl := flag.NewFlagSet(name, flag.ContinueOnError)
+	if cmd.lenient {
+		fl.BoolVar(&c.lenient, "lenient", false, "report missing textures and bad material indices as warnings")
+	}
+	if cmd.out != "" {
+		fl.StringVar(&c.outDir, "o", "", "output directory, defaults to next to each input")
+		fl.BoolVar(&c.overwrite, "f", false, "overwrite existing outputs")
+		fl.BoolVar(&c.newer, "u", false, "only overwrite outputs older than their input")
+		fl.IntVar(&c.workers, "j", 0, "files converted at once, defaults to the number of CPUs")
+	} else {
+		// reports are printed as they are made
+		c.workers = 1
+	}
+	if cmd.name == "to-gltf" {
+		fl.BoolVar(&c.gltf, "gltf", false, "write .gltf with an embedded buffer instead of .glb")
+	}
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() == 0 {
+		return errors.New("no input files")
+	}
+
+	opts := &bin.BatchOptions{
+		Exts:         []string{cmd.in},
+		OutExt:       cmd.out,
+		OutDir:       c.outDir,
+		Workers:      c.workers,
+		KeepExisting: !c.overwrite && !c.newer,
+		Incremental:  !c.overwrite && c.newer,
+		Progress:     progress,
+	}
+	if c.gltf {
+		opts.OutExt = ".gltf"
+	}
+	failed := false
+	for _, arg := range fl.Args() {
+		results, err := bin.Batch(context.Background(), arg, opts, cmd.run(c))
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			failed = failed || r.Err != nil
+		}
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func progress(r bin.BatchResult) {
+	for _, w := range r.Warnings {
+		fmt.Fprintf(os.Stderr, "%s: warning: %v\n", r.Path, w)
+	}
+	switch {
+	case r.Err != nil:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", r.Path, r.Err)
+	case r.Skipped:
+		fmt.Printf("%s: skipped, %s is kept\n", r.Path, r.Output)
+	case r.Output != "":
+		fmt.Printf("%s -> %s (%v)\n", r.Path, r.Output, r.Duration.Round(time.Millisecond))
+	}
+}
+
+func (c *config) options() *bin.ConvertOptions {
+	return &bin.ConvertOptions{CollectWarnings: c.lenient}
+}
+
+func info(c *config, in, _ string) error {
+	fsys, name, err := bin.RootFS(in)
+	if err != nil {
+		return err
+	}
+	ts, obj, err := bin.ThreeJSModelFromFS(fsys, name)
+	if err != nil {
+		return err
+	}
+	st := obj.Stats()
+	fmt.Printf("%s\n", in)
+	fmt.Printf("  vertices %d (%d unused), normals %d (%d unused), uvs %d (%d unused), colors %d\n",
+		st.Vertices, st.UnusedVertices, st.Normals, st.UnusedNormals, st.UVs, st.UnusedUVs, st.Colors)
+	var buckets []string
+	for b, n := range st.Faces {
+		if n > 0 {
+			buckets = append(buckets, fmt.Sprintf("%v %d", bin.Bucket(b), n))
+		}
+	}
+	fmt.Printf("  faces %s; %d triangles\n", strings.Join(buckets, ", "), st.Triangles)
+	_, sp := obj.Bounds(&ts.Topology)
+	fmt.Printf("  bounds %v to %v, area %g\n", st.Min, st.Max, st.Area())
+	fmt.Printf("  placed bounding sphere %v radius %g\n", sp.Center, sp.Radius)
+	fmt.Printf("  materials %d\n", len(ts.Materials))
+	for i, m := range ts.Materials {
+		var ms bin.MaterialStats
+		if i < len(st.Materials) {
+			ms = st.Materials[i]
+		}
+		fmt.Printf("    %d %s: %d faces, %d triangles, area %g\n", i, m.DbgName, ms.Faces, ms.Triangles, ms.Area)
+	}
+	if len(st.Materials) > len(ts.Materials) {
+		fmt.Printf("    faces use material %d of %d\n", len(st.Materials)-1, len(ts.Materials))
+	}
+	for _, m := range ts.Metadata.Mismatches(obj) {
+		fmt.Printf("  metadata disagrees, %s\n", m)
+	}
+	if n := len(ts.Topology.Anchors); n > 0 {
+		fmt.Printf("  anchors %d\n", n)
+		for _, a := range ts.Topology.Anchors {
+			fmt.Printf("    %s center %v normal %v unit %g\n", a.Name, a.Center, a.Normal, a.Unit)
+		}
+	}
+	return nil
+}
+
+func validate(c *config, in, _ string) error {
+	fsys, name, err := bin.RootFS(in)
+	if err != nil {
+		return err
+	}
+	ts, obj, err := bin.ThreeJSModelFromFS(fsys, name)
+	if err != nil {
+		return err
+	}
+	fatal := 0
+	for _, fd := range obj.ValidateMaterials(len(ts.Materials)) {
+		fmt.Printf("%s: %v\n", in, fd)
+		if fd.Kind.Fatal() {
+			fatal++
+		}
+	}
+	if err := ts.Topology.Validate(); err != nil {
+		fmt.Printf("%s: topology: %v\n", in, err)
+		fatal++
+	}
+	if fatal > 0 {
+		return fmt.Errorf("%d problems", fatal)
+	}
+	return nil
+}
+
+func toObj(c *config, in, out string) error {
+	fsys, name, err := bin.RootFS(in)
+	if err != nil {
+		return err
+	}
+	ts, obj, err := bin.ThreeJSModelFromFS(fsys, name)
+	if err != nil {
+		return err
+	}
+	rebase(ts.Materials, in, out)
+	return bin.WriteObj(ts, obj, out)
+}
+
+func fromObj(c *config) bin.BatchFunc {
+	return func(ctx context.Context, in, out string) ([]error, error) {
+		fsys, name, err := bin.RootFS(in)
+		if err != nil {
+			return nil, err
+		}
+		// texture paths come back relative to the directory of the obj
+		ts, obj, warnings, err := bin.ThreeJSModelFromObjFS(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		ts.Metadata.Source = filepath.Base(in)
+		rebase(ts.Materials, in, out)
+		return warnings, bin.WriteThreejsBin(ts, obj, out)
+	}
+}
+
+// rebase makes the texture paths of mtls, relative to in, relative to out.
+func rebase(mtls []bin.Material, in, out string) {
+	rel, err := filepath.Rel(filepath.Dir(out), filepath.Dir(in))
+	if err != nil || rel == "." {
+		return
+	}
+	for i := range mtls {
+		mtls[i].RebaseMaps(filepath.ToSlash(rel))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const boxObj = `v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0
+vt 0 0
+vt 1 0
+vt 1 1
+vt 0 1
+vn 0 0 1
+f 1/1/1 2/2/1 3/3/1 4/4/1
+f 1 2 3
+`
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	src, out := filepath.Join(dir, "src"), filepath.Join(dir, "out")
+	if err := os.MkdirAll(filepath.Join(src, "a"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a", "box.obj"), []byte(boxObj), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run("from-obj", []string{"-o", out, src}); err != nil {
+		t.Fatal(err)
+	}
+	model := filepath.Join(out, "a", "box.json")
+	for _, cmd := range []string{"info", "validate", "to-gltf", "to-mst", "to-obj"} {
+		if err := run(cmd, []string{out}); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	for _, ext := range []string{".bin", ".glb", ".mst", ".obj", ".mtl"} {
+		if _, err := os.Stat(filepath.Join(out, "a", "box"+ext)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	mstPath := filepath.Join(out, "a", "box.mst")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(mstPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := run("to-mst", []string{model}); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := os.Stat(mstPath); !st.ModTime().Equal(old) {
+		t.Errorf("existing output overwritten")
+	}
+	if err := run("to-mst", []string{"-u", model}); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := os.Stat(mstPath); st.ModTime().Equal(old) {
+		t.Errorf("older output not updated")
+	}
+
+	if err := run("to-mst", []string{filepath.Join(dir, "missing.json")}); err == nil {
+		t.Errorf("missing input not reported")
+	}
+	if err := run("info", []string{"-lenient", out}); err == nil {
+		t.Errorf("-lenient accepted by info")
+	}
+	if err := run("bogus", nil); err == nil {
+		t.Errorf("unknown command accepted")
+	}
+}
+
+func TestFromObjParentMtl(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"models/box.obj":    "mtllib ../materials/box.mtl\nusemtl red\n" + boxObj,
+		"materials/box.mtl": "newmtl red\nKd 1 0 0\nmap_Kd ../textures/red.png\n",
+		"textures/red.png":  "",
+	}
+	for name, data := range files {
+		fpath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fpath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(dir, "out")
+	if err := run("from-obj", []string{"-o", out, filepath.Join(dir, "models", "box.obj")}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(out, "box.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"mapDiffuse":"../textures/red.png"`) {
+		t.Errorf("texture path not kept: %s", data)
+	}
+}
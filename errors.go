@@ -0,0 +1,32 @@
+package bin
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMissingBuffer   = errors.New("missing buffer")
+	ErrCorruptBuffer   = errors.New("corrupt buffer")
+	ErrMaterialIndex   = errors.New("material index out of range")
+	ErrMissingTexture  = errors.New("missing texture")
+	ErrMissingMaterial = errors.New("missing material library")
+	ErrAveragedMap     = errors.New("texture map reduced to its average color")
+)
+
+type ConvertError struct {
+	Kind error
+	Path string
+	Err  error
+}
+
+func (e *ConvertError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %v", e.Path, e.Kind)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.Path, e.Kind, e.Err)
+}
+
+func (e *ConvertError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
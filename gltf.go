@@ -0,0 +1,935 @@
+package bin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/flywave/gltf"
+	"github.com/flywave/gltf/modeler"
+	mst "github.com/flywave/go-mst"
+	dmat "github.com/flywave/go3d/float64/mat4"
+	dquat "github.com/flywave/go3d/float64/quaternion"
+	dvec3 "github.com/flywave/go3d/float64/vec3"
+	"github.com/flywave/go3d/vec3"
+)
+
+// BuildGltf is mst.BuildGltf plus a COLOR_0 attribute for every node that
+// carries vertex colors and the node matrices, which go-mst leaves out.
+// Anchors, usually ConvertResult.Anchors, are added as root nodes of the
+// first scene.
+func BuildGltf(doc *gltf.Document, mh *mst.Mesh, anchors ...Anchor) error {
+	meshOff, nodeOff := len(doc.Meshes), len(doc.Nodes)
+	if err := mst.BuildGltf(doc, mh, false, false); err != nil {
+		return err
+	}
+	buffer := doc.Buffers[0]
+	for i, nd := range mh.Nodes {
+		if nd.Mat != nil && nodeOff+i < len(doc.Nodes) {
+			var m [16]float32
+			for k, v := range nd.Mat.Slice() {
+				m[k] = float32(v)
+			}
+			doc.Nodes[nodeOff+i].Matrix = m
+		}
+		if len(nd.Colors) == 0 || len(nd.Colors) != len(nd.Vertices) || meshOff+i >= len(doc.Meshes) {
+			continue
+		}
+		if pad := buffer.ByteLength % 4; pad != 0 {
+			buffer.Data = append(buffer.Data, make([]byte, 4-pad)...)
+			buffer.ByteLength += 4 - pad
+		}
+
+		buf := bytes.NewBuffer(nil)
+		for _, c := range nd.Colors {
+			binary.Write(buf, binary.LittleEndian, [3]float32{float32(c[0]) / 255, float32(c[1]) / 255, float32(c[2]) / 255})
+		}
+		bv := uint32(len(doc.BufferViews))
+		doc.BufferViews = append(doc.BufferViews, &gltf.BufferView{
+			Buffer:     0,
+			ByteOffset: buffer.ByteLength,
+			ByteLength: uint32(buf.Len()),
+			Target:     gltf.TargetArrayBuffer,
+		})
+		buffer.Data = append(buffer.Data, buf.Bytes()...)
+		buffer.ByteLength += uint32(buf.Len())
+
+		acc := uint32(len(doc.Accessors))
+		doc.Accessors = append(doc.Accessors, &gltf.Accessor{
+			BufferView:    &bv,
+			ComponentType: gltf.ComponentFloat,
+			Type:          gltf.AccessorVec3,
+			Count:         uint32(len(nd.Colors)),
+		})
+		for _, p := range doc.Meshes[meshOff+i].Primitives {
+			p.Attributes[gltf.COLOR_0] = acc
+		}
+	}
+	for i := range anchors {
+		doc.Nodes = append(doc.Nodes, anchorNode(&anchors[i], i))
+		doc.Scenes[0].Nodes = append(doc.Scenes[0].Nodes, uint32(len(doc.Nodes)-1))
+	}
+	return nil
+}
+
+// ConvertGltf converts the model at name to glTF without going through
+// mst.Mesh, so material names and the topology survive.
+func ConvertGltf(fsys fs.FS, name string, opts *ConvertOptions) (*ConvertResult, error) {
+	ts, obj, err := ThreeJSModelFromFS(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return ThreejsToGltf(ts, obj, fsys, name, opts)
+}
+
+// ThreejsToGltf builds a glTF document with one primitive per material.
+// Texture paths are resolved relative to name in fsys; with a nil fsys
+// textures are left out. Three.js puts the uv origin at the bottom of an
+// image and glTF at the top, so v is flipped.
+func ThreejsToGltf(ts *ThreeJSObj, obj *Binobj, fsys fs.FS, name string, opts *ConvertOptions) (*ConvertResult, error) {
+	res := &ConvertResult{}
+	if err := res.validate(obj, name, opts); err != nil {
+		return nil, err
+	}
+
+	doc := gltf.NewDocument()
+	doc.Asset.Generator = "go-3jsbin"
+	doc.Buffers = []*gltf.Buffer{{}}
+
+	mtlcount := len(ts.Materials)
+	prims := make([]*gltfPrimitive, mtlcount)
+	normals := obj.GetDecodedNormals()
+	fallback := false
+	for t := range obj.Triangles() {
+		mtl := int(t.Material)
+		if mtl >= mtlcount {
+			if t.Half == 0 {
+				err := res.warn(opts, &ConvertError{Kind: ErrMaterialIndex, Path: name, Err: fmt.Errorf("%s face %d uses material %d of %d", t.Bucket, t.Face, mtl, mtlcount)})
+				if err != nil {
+					return nil, err
+				}
+			}
+			mtl = mtlcount
+			fallback = true
+		}
+		for len(prims) <= mtl {
+			prims = append(prims, nil)
+		}
+		if prims[mtl] == nil {
+			prims[mtl] = &gltfPrimitive{index: make(map[gltfCorner]uint32), colors: len(obj.Colors) > 0}
+		}
+		p := prims[mtl]
+		p.normals = p.normals || t.Normals != nil
+		p.uvs = p.uvs || t.Uvs != nil
+	}
+
+	face := -1
+	for t := range obj.Triangles() {
+		if t.Half == 0 {
+			face++
+		}
+		p := prims[min(int(t.Material), mtlcount)]
+		for k := range t.Vertices {
+			p.indices = append(p.indices, p.corner(obj, normals, &t, k, face))
+		}
+	}
+
+	mesh := &gltf.Mesh{Name: modelName(ts, name)}
+	textures := make(map[string]uint32)
+	for i, p := range prims {
+		if p == nil {
+			continue
+		}
+		mi := uint32(len(doc.Materials))
+		if i < mtlcount {
+			gm, err := res.gltfMaterial(doc, &ts.Materials[i], fsys, path.Dir(name), textures, opts)
+			if err != nil {
+				return nil, err
+			}
+			doc.Materials = append(doc.Materials, gm)
+		} else if fallback {
+			doc.Materials = append(doc.Materials, &gltf.Material{
+				Name:                 "fallback",
+				DoubleSided:          true,
+				PBRMetallicRoughness: &gltf.PBRMetallicRoughness{BaseColorFactor: &[4]float32{0xee / 255.0, 0xee / 255.0, 0xee / 255.0, 1}},
+			})
+		}
+		mesh.Primitives = append(mesh.Primitives, p.write(doc, mi))
+	}
+
+	res.Anchors = ts.Topology.WorldAnchors()
+	res.Bounds, res.Sphere = obj.Bounds(&ts.Topology)
+	res.Doc = doc
+	if doc.Buffers[0].ByteLength == 0 {
+		// glTF wants buffers of at least one byte
+		doc.Buffers = nil
+	}
+	// glTF wants a mesh to have primitives; a model without faces only
+	// gets a node when it has anchors to hang on it
+	if len(mesh.Primitives) == 0 && len(ts.Topology.Anchors) == 0 {
+		return res, nil
+	}
+
+	node := &gltf.Node{Name: mesh.Name}
+	if len(mesh.Primitives) > 0 {
+		m := uint32(len(doc.Meshes))
+		doc.Meshes = append(doc.Meshes, mesh)
+		node.Mesh = &m
+	}
+	topologyNode(node, &ts.Topology)
+	doc.Nodes = append(doc.Nodes, node)
+	doc.Scenes[0].Nodes = append(doc.Scenes[0].Nodes, uint32(len(doc.Nodes)-1))
+	for i := range ts.Topology.Anchors {
+		node.Children = append(node.Children, uint32(len(doc.Nodes)))
+		doc.Nodes = append(doc.Nodes, anchorNode(&ts.Topology.Anchors[i], i))
+	}
+	// the position accessors bound each primitive in model space, the
+	// extras the whole model in scene space
+	node.Extras = map[string]interface{}{"topology": &ts.Topology, "bounds": res.Bounds, "sphere": res.Sphere}
+	return res, nil
+}
+
+// WriteGltf saves doc as binary glTF when fpath ends in .glb, otherwise as
+// json with the buffer embedded.
+func WriteGltf(doc *gltf.Document, fpath string) error {
+	if strings.EqualFold(filepath.Ext(fpath), ".glb") {
+		return gltf.SaveBinary(doc, fpath)
+	}
+	for _, b := range doc.Buffers {
+		if b.URI == "" {
+			b.EmbeddedResource()
+		}
+	}
+	return gltf.Save(doc, fpath)
+}
+
+func modelName(ts *ThreeJSObj, name string) string {
+	if ts.Metadata.Source != "" {
+		name = ts.Metadata.Source
+	}
+	base := path.Base(name)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+func topologyNode(node *gltf.Node, tp *Topology) {
+	sc, q := tp.ScaleVec(), tp.Quaternion()
+	node.Scale = [3]float32{float32(sc[0]), float32(sc[1]), float32(sc[2])}
+	node.Rotation = [4]float32{float32(q[0]), float32(q[1]), float32(q[2]), float32(q[3])}
+	if len(tp.Offset) == 3 {
+		node.Translation = [3]float32{float32(tp.Offset[0]), float32(tp.Offset[1]), float32(tp.Offset[2])}
+	}
+}
+
+// anchorNode places an empty node at the anchor center with its +Z axis
+// along the anchor normal. The anchor itself goes into the extras, which is
+// what GltfAnchors reads back.
+func anchorNode(a *Anchor, i int) *gltf.Node {
+	name := a.Name
+	if name == "" {
+		name = fmt.Sprintf("anchor_%d", i)
+	}
+	node := &gltf.Node{Name: name, Extras: map[string]interface{}{"anchor": a}}
+	if len(a.Center) == 3 {
+		node.Translation = [3]float32{float32(a.Center[0]), float32(a.Center[1]), float32(a.Center[2])}
+	}
+	if n := a.normal(); n.Length() > 0 {
+		n.Normalize()
+		q := shortestRotation(&dvec3.UnitZ, &n)
+		node.Rotation = [4]float32{float32(q[0]), float32(q[1]), float32(q[2]), float32(q[3])}
+	}
+	return node
+}
+
+// gltfCorner identifies a glTF vertex; face is only set for corners of flat
+// faces that need their own face normal.
+type gltfCorner struct {
+	vertex, normal, uv, color uint32
+	face                      int
+}
+
+type gltfPrimitive struct {
+	index                map[gltfCorner]uint32
+	normals, uvs, colors bool
+	positions, nrms      [][3]float32
+	texcoords            [][2]float32
+	vcolors              [][3]float32
+	indices              []uint32
+}
+
+func (p *gltfPrimitive) corner(obj *Binobj, normals [][3]float32, t *Triangle, k, face int) uint32 {
+	c := gltfCorner{vertex: t.Vertices[k], uv: math.MaxUint32, color: math.MaxUint32, face: -1}
+	if p.normals {
+		if t.Normals != nil {
+			c.normal = t.Normals[k]
+		} else {
+			c.face = face
+		}
+	}
+	if t.Uvs != nil {
+		c.uv = t.Uvs[k]
+	}
+	if t.Colors != nil {
+		c.color = t.Colors[k]
+	}
+	if id, ok := p.index[c]; ok {
+		return id
+	}
+
+	id := uint32(len(p.positions))
+	p.index[c] = id
+	p.positions = append(p.positions, obj.Vectilers[c.vertex])
+	if p.normals {
+		if c.face < 0 {
+			p.nrms = append(p.nrms, normals[c.normal])
+		} else {
+			p.nrms = append(p.nrms, flatNormal(obj, t.Vertices[:]))
+		}
+	}
+	if p.uvs {
+		var uv [2]float32
+		if c.uv != math.MaxUint32 {
+			uv = obj.UVs[c.uv]
+		}
+		p.texcoords = append(p.texcoords, [2]float32{uv[0], 1 - uv[1]})
+	}
+	if p.colors {
+		cl := [3]float32{1, 1, 1}
+		if c.color != math.MaxUint32 {
+			hc := hexColor(obj.Colors[c.color])
+			cl = [3]float32{float32(hc[0]) / 255, float32(hc[1]) / 255, float32(hc[2]) / 255}
+		}
+		p.vcolors = append(p.vcolors, cl)
+	}
+	return id
+}
+
+func flatNormal(obj *Binobj, vt []uint32) [3]float32 {
+	a, b, c := (*vec3.T)(&obj.Vectilers[vt[0]]), (*vec3.T)(&obj.Vectilers[vt[1]]), (*vec3.T)(&obj.Vectilers[vt[2]])
+	ab := vec3.Sub(b, a)
+	ac := vec3.Sub(c, a)
+	n := vec3.Cross(&ab, &ac)
+	if n.Length() == 0 {
+		return [3]float32{0, 0, 1}
+	}
+	n.Normalize()
+	return n
+}
+
+func (p *gltfPrimitive) write(doc *gltf.Document, mtl uint32) *gltf.Primitive {
+	prim := &gltf.Primitive{Attributes: gltf.Attribute{}, Material: &mtl, Mode: gltf.PrimitiveTriangles}
+	prim.Attributes[gltf.POSITION] = modeler.WritePosition(doc, p.positions)
+	if p.normals {
+		prim.Attributes[gltf.NORMAL] = modeler.WriteNormal(doc, p.nrms)
+	}
+	if p.uvs {
+		prim.Attributes[gltf.TEXCOORD_0] = modeler.WriteTextureCoord(doc, p.texcoords)
+	}
+	if p.colors {
+		prim.Attributes[gltf.COLOR_0] = modeler.WriteColor(doc, p.vcolors)
+	}
+	var idx uint32
+	if len(p.positions) <= math.MaxUint16 {
+		ind := make([]uint16, len(p.indices))
+		for i, v := range p.indices {
+			ind[i] = uint16(v)
+		}
+		idx = modeler.WriteIndices(doc, ind)
+	} else {
+		idx = modeler.WriteIndices(doc, p.indices)
+	}
+	prim.Indices = &idx
+	return prim
+}
+
+// gltfImage returns the image data to embed for ph and its mime type. The
+// image made by load is encoded as png; without load the file is kept when
+// glTF can show it.
+func gltfImage(fsys fs.FS, ph string, load func(ph string) (image.Image, error)) ([]byte, string, error) {
+	if load == nil {
+		data, err := fs.ReadFile(fsys, ph)
+		if err != nil {
+			return nil, "", err
+		}
+		_, ft, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		if ft == "png" || ft == "jpeg" {
+			return data, "image/" + ft, nil
+		}
+		load = func(ph string) (image.Image, error) {
+			return readImage(bytes.NewReader(data), ft)
+		}
+	}
+	img, err := load(ph)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+func (r *ConvertResult) gltfMaterial(doc *gltf.Document, mtl *Material, fsys fs.FS, dir string, textures map[string]uint32, opts *ConvertOptions) (*gltf.Material, error) {
+	m := *mtl
+	gm := &gltf.Material{Name: m.DbgName, DoubleSided: true}
+
+	// texture loads an image once per kind and path and returns its
+	// texture index, or nil when the image is missing and that is allowed.
+	// With a nil load png and jpeg files are embedded as they are, anything
+	// else is converted to png.
+	texture := func(kind, file string, load func(ph string) (image.Image, error)) (*uint32, error) {
+		if file == "" || fsys == nil {
+			return nil, nil
+		}
+		ph := resolvePath(dir, file)
+		if id, ok := textures[kind+":"+ph]; ok {
+			return &id, nil
+		}
+		data, mime, err := gltfImage(fsys, ph, load)
+		if err == nil {
+			var src uint32
+			src, err = modeler.WriteImage(doc, path.Base(ph), mime, bytes.NewReader(data))
+			id := uint32(len(doc.Textures))
+			doc.Textures = append(doc.Textures, &gltf.Texture{Source: &src})
+			textures[kind+":"+ph] = id
+			return &id, err
+		}
+		return nil, r.warn(opts, &ConvertError{Kind: ErrMissingTexture, Path: ph, Err: err})
+	}
+
+	if m.MapSpecular != "" && fsys != nil {
+		ph := resolvePath(dir, m.MapSpecular)
+		avg, err := averageColor(fsys, ph)
+		if err != nil {
+			if err := r.warn(opts, &ConvertError{Kind: ErrMissingTexture, Path: ph, Err: err}); err != nil {
+				return nil, err
+			}
+		} else {
+			m.ColorSpecular = scaleColor(m.ColorSpecular, avg)
+		}
+	}
+	base, metallic, roughness := m.PbrFactors()
+	mf, rf := float32(metallic), float32(roughness)
+	opacity := float32(m.Opacity)
+	if opacity <= 0 {
+		opacity = 1
+	}
+	gm.PBRMetallicRoughness = &gltf.PBRMetallicRoughness{
+		BaseColorFactor: &[4]float32{float32(base[0]), float32(base[1]), float32(base[2]), opacity},
+		MetallicFactor:  &mf,
+		RoughnessFactor: &rf,
+	}
+	if opacity < 1 || m.MapAlpha != "" {
+		gm.AlphaMode = gltf.AlphaBlend
+	}
+
+	var ap *string
+	if m.MapAlpha != "" {
+		ph := resolvePath(dir, m.MapAlpha)
+		ap = &ph
+	}
+	var diffuse func(ph string) (image.Image, error)
+	if ap != nil {
+		diffuse = func(ph string) (image.Image, error) {
+			return diffuseImage(fsys, ph, ap)
+		}
+	}
+	id, err := texture("diffuse", m.MapDiffuse, diffuse)
+	if err != nil {
+		return nil, err
+	}
+	if id != nil {
+		gm.PBRMetallicRoughness.BaseColorTexture = &gltf.TextureInfo{Index: *id}
+	}
+
+	if len(m.ColorEmissive) >= 3 {
+		gm.EmissiveFactor = [3]float32{float32(m.ColorEmissive[0]), float32(m.ColorEmissive[1]), float32(m.ColorEmissive[2])}
+	}
+	if id, err = texture("emissive", m.MapEmissive, nil); err != nil {
+		return nil, err
+	}
+	if id != nil {
+		gm.EmissiveTexture = &gltf.TextureInfo{Index: *id}
+		if len(m.ColorEmissive) < 3 {
+			gm.EmissiveFactor = [3]float32{1, 1, 1}
+		}
+	}
+
+	if id, err = texture("ambient", m.MapAmbient, nil); err != nil {
+		return nil, err
+	}
+	if id != nil {
+		gm.OcclusionTexture = &gltf.OcclusionTexture{Index: id}
+	}
+
+	scale := m.MapBumpScale
+	if scale == 0 {
+		scale = 1
+	}
+	id, err = texture(fmt.Sprintf("bump%g", scale), m.MapBump, func(ph string) (image.Image, error) {
+		return bumpImage(fsys, ph, scale)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if id != nil {
+		gm.NormalTexture = &gltf.NormalTexture{Index: id}
+	}
+	return gm, nil
+}
+
+// ThreeJSModelFromGltf flattens the default scene of doc into one model,
+// baking node transforms into the vertices. Embedded images are returned by
+// the file name the materials use for them; images with an external uri are
+// referenced by that uri and not returned. Anchor nodes become topology
+// anchors in the same space as the baked vertices. Triangle strips and fans
+// are split into triangles; point and line primitives are left out, and a
+// document that has nothing else is an error.
+func ThreeJSModelFromGltf(doc *gltf.Document) (*ThreeJSObj, *Binobj, map[string][]byte, error) {
+	rd := &gltfReader{doc: doc, obj: &Binobj{}, mtlIndex: make(map[int]int), images: make(map[string][]byte), imageNames: make(map[uint32]string)}
+
+	var roots []uint32
+	if len(doc.Scenes) > 0 {
+		sc := 0
+		if doc.Scene != nil && int(*doc.Scene) < len(doc.Scenes) {
+			sc = int(*doc.Scene)
+		}
+		roots = doc.Scenes[sc].Nodes
+	} else {
+		for i := range doc.Nodes {
+			roots = append(roots, uint32(i))
+		}
+	}
+	for _, n := range roots {
+		if err := rd.node(n, &dmat.Ident, 0); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	obj := rd.obj
+	obj.Setup()
+
+	if len(rd.materials) == 0 && obj.Header.VerticeCount > 0 {
+		rd.materials = append(rd.materials, defaultMaterial(0))
+	}
+	ts := &ThreeJSObj{
+		Metadata:  newMetadata(obj, len(rd.materials)),
+		Materials: rd.materials,
+		Topology:  identityTopology(),
+	}
+	if ts.Metadata.FaceCount == 0 && rd.skipped > 0 {
+		return nil, nil, nil, fmt.Errorf("no triangles, %d point or line primitives left out", rd.skipped)
+	}
+	ts.Topology.Anchors = rd.anchors
+	ts.Topology.AnchorCount = len(rd.anchors)
+	return ts, obj, rd.images, nil
+}
+
+// gltfTriangles splits the indices of a triangle list, strip or fan into
+// triangles, keeping the winding of every second strip triangle the way the
+// glTF spec orders its corners.
+func gltfTriangles(mode gltf.PrimitiveMode, indices []uint32) [][3]uint32 {
+	var ret [][3]uint32
+	switch mode {
+	case gltf.PrimitiveTriangleStrip:
+		for i := 0; i+2 < len(indices); i++ {
+			if i%2 == 0 {
+				ret = append(ret, [3]uint32{indices[i], indices[i+1], indices[i+2]})
+			} else {
+				ret = append(ret, [3]uint32{indices[i], indices[i+2], indices[i+1]})
+			}
+		}
+	case gltf.PrimitiveTriangleFan:
+		for i := 0; i+2 < len(indices); i++ {
+			ret = append(ret, [3]uint32{indices[i+1], indices[i+2], indices[0]})
+		}
+	default:
+		for i := 0; i+2 < len(indices); i += 3 {
+			ret = append(ret, [3]uint32{indices[i], indices[i+1], indices[i+2]})
+		}
+	}
+	return ret
+}
+
+// GltfAnchors returns the anchors written by ThreejsToGltf or BuildGltf,
+// moved into scene space by the transforms of their parent nodes.
+func GltfAnchors(doc *gltf.Document) ([]Anchor, error) {
+	ts, _, _, err := ThreeJSModelFromGltf(doc)
+	if err != nil {
+		return nil, err
+	}
+	return ts.Topology.Anchors, nil
+}
+
+// GltfToThreejsBin converts a .gltf or .glb file to a model json at fpath
+// with its .bin and the embedded textures next to it.
+func GltfToThreejsBin(src, fpath string) error {
+	doc, err := gltf.Open(src)
+	if err != nil {
+		return err
+	}
+	ts, obj, images, err := ThreeJSModelFromGltf(doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	ts.Metadata.Source = filepath.Base(src)
+	dir := filepath.Dir(fpath)
+	for name, data := range images {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return WriteThreejsBin(ts, obj, fpath)
+}
+
+type gltfReader struct {
+	doc        *gltf.Document
+	obj        *Binobj
+	materials  []Material
+	mtlIndex   map[int]int
+	images     map[string][]byte
+	imageNames map[uint32]string
+	anchors    []Anchor
+	// skipped counts the point and line primitives, which have no faces
+	skipped int
+}
+
+func (rd *gltfReader) node(i uint32, parent *dmat.T, depth int) error {
+	if int(i) >= len(rd.doc.Nodes) {
+		return fmt.Errorf("node %d out of %d", i, len(rd.doc.Nodes))
+	}
+	if depth > len(rd.doc.Nodes) {
+		return errors.New("node hierarchy has a cycle")
+	}
+	nd := rd.doc.Nodes[i]
+
+	var local dmat.T
+	if m := nd.MatrixOrDefault(); m != gltf.DefaultMatrix {
+		var arr [16]float64
+		for k, v := range m {
+			arr[k] = float64(v)
+		}
+		local = dmat.FromArray(arr)
+	} else {
+		t, r, s := nd.TranslationOrDefault(), nd.RotationOrDefault(), nd.ScaleOrDefault()
+		quat := dquat.T{float64(r[0]), float64(r[1]), float64(r[2]), float64(r[3])}
+		local = *dmat.Compose(&dvec3.T{float64(t[0]), float64(t[1]), float64(t[2])}, &quat, &dvec3.T{float64(s[0]), float64(s[1]), float64(s[2])})
+	}
+	world := dmat.AssignMul(parent, &local)
+
+	if ex, ok := nd.Extras.(map[string]interface{}); ok && ex["anchor"] != nil {
+		var a Anchor
+		bt, err := json.Marshal(ex["anchor"])
+		if err == nil {
+			err = json.Unmarshal(bt, &a)
+		}
+		if err != nil {
+			return fmt.Errorf("node %d anchor: %w", i, err)
+		}
+		rd.anchors = append(rd.anchors, TransformAnchor(&a, parent))
+	}
+	if nd.Mesh != nil {
+		if int(*nd.Mesh) >= len(rd.doc.Meshes) {
+			return fmt.Errorf("mesh %d out of %d", *nd.Mesh, len(rd.doc.Meshes))
+		}
+		for p, prim := range rd.doc.Meshes[*nd.Mesh].Primitives {
+			if err := rd.primitive(prim, world); err != nil {
+				return fmt.Errorf("mesh %d primitive %d: %w", *nd.Mesh, p, err)
+			}
+		}
+	}
+	for _, c := range nd.Children {
+		if err := rd.node(c, world, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rd *gltfReader) accessor(attr string, prim *gltf.Primitive) (*gltf.Accessor, error) {
+	i, ok := prim.Attributes[attr]
+	if !ok {
+		return nil, nil
+	}
+	if int(i) >= len(rd.doc.Accessors) {
+		return nil, fmt.Errorf("%s accessor %d out of %d", attr, i, len(rd.doc.Accessors))
+	}
+	return rd.doc.Accessors[i], nil
+}
+
+func (rd *gltfReader) primitive(prim *gltf.Primitive, world *dmat.T) error {
+	switch prim.Mode {
+	case gltf.PrimitiveTriangles, gltf.PrimitiveTriangleStrip, gltf.PrimitiveTriangleFan:
+	default:
+		rd.skipped++
+		return nil
+	}
+	doc, obj := rd.doc, rd.obj
+
+	acc, err := rd.accessor(gltf.POSITION, prim)
+	if err != nil || acc == nil {
+		return err
+	}
+	positions, err := modeler.ReadPosition(doc, acc, nil)
+	if err != nil {
+		return err
+	}
+	var normals [][3]float32
+	if acc, err := rd.accessor(gltf.NORMAL, prim); err != nil {
+		return err
+	} else if acc != nil {
+		if normals, err = modeler.ReadNormal(doc, acc, nil); err != nil {
+			return err
+		}
+	}
+	var uvs [][2]float32
+	if acc, err := rd.accessor(gltf.TEXCOORD_0, prim); err != nil {
+		return err
+	} else if acc != nil {
+		if uvs, err = modeler.ReadTextureCoord(doc, acc, nil); err != nil {
+			return err
+		}
+	}
+	var colors [][4]uint8
+	if acc, err := rd.accessor(gltf.COLOR_0, prim); err != nil {
+		return err
+	} else if acc != nil {
+		if colors, err = modeler.ReadColor(doc, acc, nil); err != nil {
+			return err
+		}
+	}
+	var indices []uint32
+	if prim.Indices != nil {
+		if int(*prim.Indices) >= len(doc.Accessors) {
+			return fmt.Errorf("indices accessor %d out of %d", *prim.Indices, len(doc.Accessors))
+		}
+		if indices, err = modeler.ReadIndices(doc, doc.Accessors[*prim.Indices], nil); err != nil {
+			return err
+		}
+	} else {
+		indices = make([]uint32, len(positions))
+		for i := range indices {
+			indices[i] = uint32(i)
+		}
+	}
+	hasNormal := len(normals) == len(positions)
+	hasUv := len(uvs) == len(positions)
+
+	vOff, nOff, uvOff := uint32(len(obj.Vectilers)), uint32(len(obj.Normals)), uint32(len(obj.UVs))
+	for _, p := range positions {
+		v := world.MulVec3(&dvec3.T{float64(p[0]), float64(p[1]), float64(p[2])})
+		obj.Vectilers = append(obj.Vectilers, [3]float32{float32(v[0]), float32(v[1]), float32(v[2])})
+	}
+	if hasNormal {
+		nmat := world.Inverted()
+		nmat.Transpose()
+		for _, n := range normals {
+			v := nmat.MulVec3W(&dvec3.T{float64(n[0]), float64(n[1]), float64(n[2])}, 0)
+			v.Normalize()
+			obj.Normals = append(obj.Normals, EncodeNormal([3]float32{float32(v[0]), float32(v[1]), float32(v[2])}))
+		}
+	}
+	if hasUv {
+		for _, uv := range uvs {
+			obj.UVs = append(obj.UVs, [2]float32{uv[0], 1 - uv[1]})
+		}
+	}
+
+	// colors are indexed per vertex; earlier primitives without colors get
+	// white so every face of a colored model has a color
+	hasColor := len(colors) == len(positions) || len(obj.Colors) > 0
+	var cOff uint32
+	if hasColor {
+		if len(obj.Colors) == 0 {
+			for i := uint32(0); i < vOff; i++ {
+				obj.Colors = append(obj.Colors, 0xffffff)
+			}
+			rd.colorFaces()
+		}
+		cOff = uint32(len(obj.Colors))
+		for i := range positions {
+			c := uint32(0xffffff)
+			if i < len(colors) {
+				c = uint32(colors[i][0])<<16 | uint32(colors[i][1])<<8 | uint32(colors[i][2])
+			}
+			obj.Colors = append(obj.Colors, c)
+		}
+	}
+
+	mtl, err := rd.material(prim.Material)
+	if err != nil {
+		return err
+	}
+	det := world.Determinant3x3()
+	for _, tri := range gltfTriangles(prim.Mode, indices) {
+		if det < 0 {
+			// mirrored nodes flip the winding
+			tri[1], tri[2] = tri[2], tri[1]
+		}
+		var vt, nl, uv [4]uint32
+		var cl *[4]uint32
+		if hasColor {
+			cl = &[4]uint32{}
+		}
+		for k, v := range tri {
+			if int(v) >= len(positions) {
+				return fmt.Errorf("index %d out of %d", v, len(positions))
+			}
+			vt[k], nl[k], uv[k] = v+vOff, v+nOff, v+uvOff
+			if cl != nil {
+				cl[k] = v + cOff
+			}
+		}
+		obj.addFace(3, vt, nl, uv, cl, uint16(mtl), hasNormal, hasUv)
+	}
+	return nil
+}
+
+// colorFaces gives the faces read before the first colored primitive the
+// color of their vertex, which is white.
+func (rd *gltfReader) colorFaces() {
+	obj := rd.obj
+	for _, t := range []*FlatTriangle{&obj.FlatTriangle, &obj.SmoothTriangle.FlatTriangle, &obj.FlatUVTriangle.FlatTriangle, &obj.SmoothUVTriangle.FlatTriangle} {
+		t.Colors = append([][3]uint32(nil), t.Vertices...)
+	}
+}
+
+func (rd *gltfReader) material(i *uint32) (int, error) {
+	key := -1
+	if i != nil {
+		key = int(*i)
+	}
+	if id, ok := rd.mtlIndex[key]; ok {
+		return id, nil
+	}
+	id := len(rd.materials)
+	if id > math.MaxUint16 {
+		return 0, fmt.Errorf("material index %d overflow", id)
+	}
+	m := defaultMaterial(id)
+	if key >= 0 {
+		if key >= len(rd.doc.Materials) {
+			return 0, fmt.Errorf("material %d out of %d", key, len(rd.doc.Materials))
+		}
+		var err error
+		if m, err = rd.gltfToMaterial(rd.doc.Materials[key], id); err != nil {
+			return 0, err
+		}
+	}
+	rd.mtlIndex[key] = id
+	rd.materials = append(rd.materials, m)
+	return id, nil
+}
+
+// gltfToMaterial is the inverse of PbrFactors: metal moves the base color
+// into the specular color and roughness becomes the specular exponent.
+func (rd *gltfReader) gltfToMaterial(gm *gltf.Material, id int) (Material, error) {
+	m := Material{
+		DbgName:      gm.Name,
+		DbgIndex:     uint32(id),
+		DbgColor:     GenerateColor(id),
+		Opacity:      1,
+		Illumination: 2,
+	}
+	if m.DbgName == "" {
+		m.DbgName = fmt.Sprintf("material_%d", id)
+	}
+	base := [4]float64{1, 1, 1, 1}
+	metallic, roughness := 1.0, 1.0
+	if pbr := gm.PBRMetallicRoughness; pbr != nil {
+		bc := pbr.BaseColorFactorOrDefault()
+		base = [4]float64{float64(bc[0]), float64(bc[1]), float64(bc[2]), float64(bc[3])}
+		metallic = float64(pbr.MetallicFactorOrDefault())
+		roughness = float64(pbr.RoughnessFactorOrDefault())
+		if pbr.BaseColorTexture != nil {
+			name, err := rd.texture(pbr.BaseColorTexture.Index)
+			if err != nil {
+				return m, err
+			}
+			m.MapDiffuse = name
+		}
+	}
+	m.ColorDiffuse = []float64{base[0] * (1 - metallic), base[1] * (1 - metallic), base[2] * (1 - metallic)}
+	m.ColorSpecular = make([]float64, 3)
+	for k := range m.ColorSpecular {
+		m.ColorSpecular[k] = dielectricSpecular + (base[k]-dielectricSpecular)*metallic
+	}
+	if m.MapDiffuse != "" && metallic < 1 {
+		// the map carries the color, keep the factor so it is not darkened
+		m.ColorDiffuse = []float64{base[0], base[1], base[2]}
+	}
+	m.SpecularCoef = 2/math.Max(roughness*roughness, 1e-4) - 2
+	if gm.AlphaMode != gltf.AlphaOpaque {
+		m.Opacity = base[3]
+	}
+	if ef := gm.EmissiveFactor; ef != [3]float32{} {
+		m.ColorEmissive = []float64{float64(ef[0]), float64(ef[1]), float64(ef[2])}
+	}
+	if gm.EmissiveTexture != nil {
+		name, err := rd.texture(gm.EmissiveTexture.Index)
+		if err != nil {
+			return m, err
+		}
+		m.MapEmissive = name
+	}
+	return m, nil
+}
+
+// texture returns the file name a material should use for a texture and
+// keeps the data of embedded images.
+func (rd *gltfReader) texture(i uint32) (string, error) {
+	doc := rd.doc
+	if int(i) >= len(doc.Textures) || doc.Textures[i].Source == nil || int(*doc.Textures[i].Source) >= len(doc.Images) {
+		return "", fmt.Errorf("texture %d has no image", i)
+	}
+	src := *doc.Textures[i].Source
+	if name, ok := rd.imageNames[src]; ok {
+		return name, nil
+	}
+	im := doc.Images[src]
+	if im.URI != "" && !im.IsEmbeddedResource() {
+		rd.imageNames[src] = im.URI
+		return im.URI, nil
+	}
+
+	var data []byte
+	var err error
+	if im.BufferView != nil {
+		if int(*im.BufferView) >= len(doc.BufferViews) {
+			return "", fmt.Errorf("image %d buffer view out of range", src)
+		}
+		data, err = modeler.ReadBufferView(doc, doc.BufferViews[*im.BufferView])
+	} else {
+		data, err = im.MarshalData()
+	}
+	if err != nil {
+		return "", err
+	}
+	ext := ".png"
+	if im.MimeType == "image/jpeg" || bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		ext = ".jpg"
+	}
+	base := strings.TrimSuffix(path.Base(im.Name), path.Ext(im.Name))
+	if im.Name == "" {
+		base = fmt.Sprintf("image_%d", src)
+	}
+	name := base + ext
+	for n := 1; rd.images[name] != nil; n++ {
+		name = fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+	rd.images[name] = data
+	rd.imageNames[src] = name
+	return name, nil
+}
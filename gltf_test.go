@@ -0,0 +1,302 @@
+package bin
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/flywave/gltf"
+	"github.com/flywave/gltf/modeler"
+	mst "github.com/flywave/go-mst"
+)
+
+func TestThreejsToGltf(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"models/box.obj":     &fstest.MapFile{Data: []byte(testObj)},
+		"models/mtl/box.mtl": &fstest.MapFile{Data: []byte(testObjMtl)},
+		"models/mtl/red.png": &fstest.MapFile{Data: buf.Bytes()},
+	}
+	ts, obj, _, err := ThreeJSModelFromObjFS(fsys, "models/box.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Topology = Topology{Scale: 2, Rotation: []float64{0, 0, 0, 1}, Offset: []float64{1, 2, 3}}
+
+	res, err := ThreejsToGltf(ts, obj, fsys, "models/box.obj", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fpath := filepath.Join(t.TempDir(), "box.glb")
+	if err := WriteGltf(res.Doc, fpath); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := gltf.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(doc.Meshes) != 1 || len(doc.Meshes[0].Primitives) != 2 || doc.Meshes[0].Name != "box" {
+		t.Fatalf("expected one mesh with a primitive per used material")
+	}
+	if doc.Materials[0].Name != "red" || doc.Materials[1].Name != "blue" {
+		t.Errorf("material names lost %q %q", doc.Materials[0].Name, doc.Materials[1].Name)
+	}
+	if doc.Materials[0].PBRMetallicRoughness.BaseColorTexture == nil || len(doc.Images) != 1 || doc.Images[0].BufferView == nil {
+		t.Errorf("texture not embedded")
+	}
+
+	red := doc.Meshes[0].Primitives[0]
+	indices, err := modeler.ReadIndices(doc, doc.Accessors[*red.Indices], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the uv quad and the flat triangle
+	if len(indices) != 9 {
+		t.Errorf("expected 9 indices, got %d", len(indices))
+	}
+	uvs, err := modeler.ReadTextureCoord(doc, doc.Accessors[red.Attributes[gltf.TEXCOORD_0]], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uvs[0] != [2]float32{0, 1} {
+		t.Errorf("v not flipped %v", uvs[0])
+	}
+	if _, ok := red.Attributes[gltf.NORMAL]; !ok {
+		t.Errorf("normals missing")
+	}
+	if pos := doc.Accessors[red.Attributes[gltf.POSITION]]; len(pos.Min) != 3 || pos.Max[1] != 1 {
+		t.Errorf("position bounds missing")
+	}
+
+	nd := doc.Nodes[0]
+	if nd.Scale != [3]float32{2, 2, 2} || nd.Translation != [3]float32{1, 2, 3} || nd.Extras == nil {
+		t.Errorf("topology not on node %+v", nd)
+	}
+}
+
+func TestGltfToThreejsBin(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"box.obj":     &fstest.MapFile{Data: []byte(testObj)},
+		"mtl/box.mtl": &fstest.MapFile{Data: []byte(testObjMtl)},
+		"mtl/red.png": &fstest.MapFile{Data: buf.Bytes()},
+	}
+	ts, obj, _, err := ThreeJSModelFromObjFS(fsys, "box.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Topology = Topology{Scale: 2, Rotation: []float64{0, 0, 0, 1}, Offset: []float64{1, 2, 3}}
+	res, err := ThreejsToGltf(ts, obj, fsys, "box.obj", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := WriteGltf(res.Doc, filepath.Join(dir, "box.gltf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := GltfToThreejsBin(filepath.Join(dir, "box.gltf"), filepath.Join(dir, "out.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts2, obj2, err := ThreeJSModelFromFS(os.DirFS(dir), "out.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts2.Materials) != 2 || ts2.Materials[0].DbgName != "red" || ts2.Materials[1].DbgName != "blue" {
+		t.Fatalf("bad materials %+v", ts2.Materials)
+	}
+	if ts2.Materials[0].MapDiffuse != "red.png" {
+		t.Errorf("texture not extracted %q", ts2.Materials[0].MapDiffuse)
+	} else if _, err := os.Stat(filepath.Join(dir, "red.png")); err != nil {
+		t.Error(err)
+	}
+	if ts2.Metadata.FaceCount != 7 || ts2.Metadata.Source != "box.gltf" {
+		t.Errorf("bad metadata %+v", ts2.Metadata)
+	}
+	// primitives carry normals and uvs for all their faces
+	if n := len(obj2.SmoothUVTriangle.Vertices); n != 7 {
+		t.Errorf("expected all faces with normals and uvs, got %d", n)
+	}
+	v := obj2.Vectilers[obj2.SmoothUVTriangle.Vertices[0][1]]
+	if v != [3]float32{3, 2, 3} {
+		t.Errorf("node transform not baked %v", v)
+	}
+	// the first half of the quad
+	uv := obj2.UVs[obj2.SmoothUVTriangle.Uvs[1][1]]
+	if uv != [2]float32{1, 0} {
+		t.Errorf("v not flipped back %v", uv)
+	}
+	if fds := obj2.ValidateMaterials(len(ts2.Materials)); len(fds) != 0 {
+		t.Errorf("unexpected findings %v", fds)
+	}
+}
+
+func TestGltfAnchors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"box.obj":     &fstest.MapFile{Data: []byte(testObj)},
+		"mtl/box.mtl": &fstest.MapFile{Data: []byte(testObjMtl)},
+	}
+	ts, obj, _, err := ThreeJSModelFromObjFS(fsys, "box.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := math.Sqrt(0.5)
+	ts.Topology = Topology{
+		Scale:       2,
+		Rotation:    []float64{0, 0, s, s},
+		Offset:      []float64{1, 2, 3},
+		AnchorCount: 1,
+		Anchors:     []Anchor{{Normal: []float64{1, 0, 0}, Center: []float64{1, 0, 0}, Unit: 0.5, Name: "plug"}},
+	}
+	check := func(what string, as []Anchor) {
+		t.Helper()
+		if len(as) != 1 || as[0].Name != "plug" {
+			t.Fatalf("%s: bad anchors %+v", what, as)
+		}
+		a := as[0]
+		want := [][]float64{{1, 4, 3}, {0, 1, 0}}
+		for i, v := range [][]float64{a.Center, a.Normal} {
+			for k := range v {
+				if math.Abs(v[k]-want[i][k]) > 1e-5 {
+					t.Errorf("%s: got %v want %v", what, v, want[i])
+				}
+			}
+		}
+		if math.Abs(a.Unit-1) > 1e-5 {
+			t.Errorf("%s: unit not scaled %v", what, a.Unit)
+		}
+	}
+
+	res, err := ThreejsToGltf(ts, obj, nil, "box.obj", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("result", res.Anchors)
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "box.glb")
+	if err := WriteGltf(res.Doc, fpath); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := gltf.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Nodes) != 2 || len(doc.Nodes[0].Children) != 1 || doc.Nodes[1].Name != "plug" {
+		t.Fatalf("anchor node missing")
+	}
+	as, err := GltfAnchors(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("gltf", as)
+
+	if err := WriteThreejsBin(ts, obj, filepath.Join(dir, "box.json")); err != nil {
+		t.Fatal(err)
+	}
+	res, err = Convert(os.DirFS(dir), "box.json", &ConvertOptions{CollectWarnings: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("mst", res.Anchors)
+	doc = mst.CreateDoc()
+	if err := BuildGltf(doc, res.Mesh, res.Anchors...); err != nil {
+		t.Fatal(err)
+	}
+	as, err = GltfAnchors(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("mst gltf", as)
+}
+
+func TestGltfStripsAndFans(t *testing.T) {
+	doc := gltf.NewDocument()
+	strip := modeler.WritePosition(doc, [][3]float32{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}, {1, 1, 0}, {0, 2, 0}})
+	fan := modeler.WritePosition(doc, [][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}, {-1, 1, 0}})
+	mesh := &gltf.Mesh{}
+	for i, mode := range []gltf.PrimitiveMode{gltf.PrimitiveTriangleStrip, gltf.PrimitiveTriangleFan, gltf.PrimitiveLines} {
+		pos := []uint32{strip, fan, strip}[i]
+		idx := modeler.WriteIndices(doc, []uint16{0, 1, 2, 3, 4})
+		mesh.Primitives = append(mesh.Primitives, &gltf.Primitive{Mode: mode, Indices: gltf.Index(idx), Attributes: map[string]uint32{gltf.POSITION: pos}})
+	}
+	doc.Meshes = []*gltf.Mesh{mesh}
+	doc.Nodes = []*gltf.Node{{Mesh: gltf.Index(0)}}
+	doc.Scenes[0].Nodes = []uint32{0}
+
+	_, obj, _, err := ThreeJSModelFromGltf(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vt := obj.FlatTriangle.Vertices
+	if len(vt) != 6 {
+		t.Fatalf("expected 3 strip and 3 fan triangles, got %v", vt)
+	}
+	// every triangle faces +z, the same as the first
+	for i, tri := range vt {
+		if n := flatNormal(obj, tri[:]); n[2] <= 0 {
+			t.Errorf("triangle %d %v flipped", i, tri)
+		}
+	}
+
+	mesh.Primitives = mesh.Primitives[2:]
+	if _, _, _, err := ThreeJSModelFromGltf(doc); err == nil {
+		t.Errorf("lines only model accepted")
+	}
+}
+
+func TestThreejsToGltfImagesAndEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{"glow.jpg": &fstest.MapFile{Data: buf.Bytes()}}
+	_, obj, err := ThreeJSModelFromJson(strings.NewReader(cubeFaceJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &ThreeJSObj{Materials: []Material{{DbgName: "glow", MapDiffuse: "glow.jpg", MapEmissive: "glow.jpg"}}, Topology: identityTopology()}
+	res, err := ThreejsToGltf(ts, obj, fsys, "model.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := res.Doc
+	if len(doc.Images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(doc.Images))
+	}
+	for _, im := range doc.Images {
+		bv := doc.BufferViews[*im.BufferView]
+		data := doc.Buffers[0].Data[bv.ByteOffset : bv.ByteOffset+bv.ByteLength]
+		if im.MimeType != "image/jpeg" || !bytes.Equal(data, buf.Bytes()) {
+			t.Errorf("jpeg not embedded as is: %s, %d bytes", im.MimeType, len(data))
+		}
+	}
+
+	res, err = ThreejsToGltf(&ThreeJSObj{Topology: identityTopology()}, &Binobj{}, nil, "empty.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Doc.Meshes) != 0 || len(res.Doc.Nodes) != 0 || len(res.Doc.Buffers) != 0 {
+		t.Errorf("empty model wrote %d meshes, %d nodes, %d buffers", len(res.Doc.Meshes), len(res.Doc.Nodes), len(res.Doc.Buffers))
+	}
+	if err := WriteGltf(res.Doc, filepath.Join(t.TempDir(), "empty.glb")); err != nil {
+		t.Error(err)
+	}
+}
@@ -8,4 +8,4 @@ require (
 	golang.org/x/image v0.26.0
 )
 
-require github.com/flywave/gltf v0.20.4-0.20250411080706-f58af20d5f38 // indirect
+require github.com/flywave/gltf v0.20.4-0.20250411080706-f58af20d5f38
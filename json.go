@@ -0,0 +1,321 @@
+package bin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	faceQuad = 1 << iota
+	faceMaterial
+	faceUv
+	faceVertexUv
+	faceNormal
+	faceVertexNormal
+	faceColor
+	faceVertexColor
+)
+
+type jsonModel struct {
+	Metadata  Metadata    `json:"metadata"`
+	Scale     float64     `json:"scale"`
+	Materials []Material  `json:"materials"`
+	BinBuffer string      `json:"buffers"`
+	Topology  Topology    `json:"topology"`
+	Vertices  []float64   `json:"vertices"`
+	Normals   []float64   `json:"normals"`
+	Colors    []uint32    `json:"colors"`
+	Uvs       [][]float64 `json:"uvs"`
+	Faces     []uint32    `json:"faces"`
+}
+
+func ThreeJSModelFromJson(data io.Reader) (*ThreeJSObj, *Binobj, error) {
+	var md jsonModel
+	err := json.NewDecoder(data).Decode(&md)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ts := &ThreeJSObj{
+		Metadata:  md.Metadata,
+		Materials: md.Materials,
+		BinBuffer: md.BinBuffer,
+		Topology:  md.Topology,
+	}
+	if md.BinBuffer != "" {
+		return ts, nil, nil
+	}
+
+	obj, err := md.binobj()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ts.Materials) == 0 && len(md.Faces) > 0 {
+		ts.Materials = append(ts.Materials, defaultMaterial(0))
+	}
+	if ts.Metadata.Version == 0 {
+		ts.Metadata.Version = 3
+	}
+	return ts, obj, nil
+}
+
+func defaultMaterial(i int) Material {
+	cl := GenerateColor(i)
+	return Material{
+		DbgName:      "default",
+		DbgIndex:     uint32(i),
+		DbgColor:     cl,
+		ColorDiffuse: []float64{float64(cl>>16&0xff) / 255, float64(cl>>8&0xff) / 255, float64(cl&0xff) / 255},
+		Opacity:      1,
+	}
+}
+
+func (md *jsonModel) binobj() (*Binobj, error) {
+	if len(md.Vertices)%3 != 0 {
+		return nil, errors.New("vertices must 3^")
+	}
+	if len(md.Normals)%3 != 0 {
+		return nil, errors.New("normals must 3^")
+	}
+
+	obj := &Binobj{}
+	scale := 1.0
+	if md.Scale != 0 {
+		scale = 1 / md.Scale
+	}
+	obj.Vectilers = make([][3]float32, len(md.Vertices)/3)
+	for i := range obj.Vectilers {
+		obj.Vectilers[i][0] = float32(md.Vertices[i*3] * scale)
+		obj.Vectilers[i][1] = float32(md.Vertices[i*3+1] * scale)
+		obj.Vectilers[i][2] = float32(md.Vertices[i*3+2] * scale)
+	}
+	normals := make([]float32, len(md.Normals))
+	for i := range md.Normals {
+		normals[i] = float32(md.Normals[i])
+	}
+	obj.SetNormals(normals)
+	if len(md.Uvs) > 0 {
+		layer := md.Uvs[0]
+		if len(layer)%2 != 0 {
+			return nil, errors.New("uvs must 2^")
+		}
+		obj.UVs = make([][2]float32, len(layer)/2)
+		for i := range obj.UVs {
+			obj.UVs[i][0] = float32(layer[i*2])
+			obj.UVs[i][1] = float32(layer[i*2+1])
+		}
+	}
+
+	obj.Colors = append(obj.Colors, md.Colors...)
+	white := -1
+
+	nUvLayers := len(md.Uvs)
+	faces := md.Faces
+	offset := 0
+	next := func() (uint32, error) {
+		if offset >= len(faces) {
+			return 0, fmt.Errorf("faces truncated at %d", offset)
+		}
+		v := faces[offset]
+		offset++
+		return v, nil
+	}
+	skip := func(n int) error {
+		if offset+n > len(faces) {
+			return fmt.Errorf("faces truncated at %d", offset)
+		}
+		offset += n
+		return nil
+	}
+
+	for offset < len(faces) {
+		tp, _ := next()
+		corners := 3
+		if tp&faceQuad != 0 {
+			corners = 4
+		}
+
+		var vt, nl, uv [4]uint32
+		for i := 0; i < corners; i++ {
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			vt[i] = v
+		}
+
+		var mtl uint32
+		if tp&faceMaterial != 0 {
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			mtl = v
+		}
+		if mtl > math.MaxUint16 {
+			return nil, fmt.Errorf("material index %d overflow", mtl)
+		}
+
+		hasUv := false
+		if tp&faceUv != 0 {
+			for l := 0; l < nUvLayers; l++ {
+				v, err := next()
+				if err != nil {
+					return nil, err
+				}
+				if l == 0 {
+					for i := 0; i < corners; i++ {
+						uv[i] = v
+					}
+					hasUv = true
+				}
+			}
+		}
+		if tp&faceVertexUv != 0 {
+			for l := 0; l < nUvLayers; l++ {
+				for i := 0; i < corners; i++ {
+					v, err := next()
+					if err != nil {
+						return nil, err
+					}
+					if l == 0 {
+						uv[i] = v
+						hasUv = true
+					}
+				}
+			}
+		}
+
+		hasNormal := false
+		if tp&faceNormal != 0 {
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i < corners; i++ {
+				nl[i] = v
+			}
+			hasNormal = true
+		}
+		if tp&faceVertexNormal != 0 {
+			for i := 0; i < corners; i++ {
+				v, err := next()
+				if err != nil {
+					return nil, err
+				}
+				nl[i] = v
+			}
+			hasNormal = true
+		}
+
+		var cl *[4]uint32
+		if len(md.Colors) > 0 {
+			cl = &[4]uint32{}
+			hasColor := false
+			if tp&faceColor != 0 {
+				v, err := next()
+				if err != nil {
+					return nil, err
+				}
+				for i := 0; i < corners; i++ {
+					cl[i] = v
+				}
+				hasColor = true
+			}
+			if tp&faceVertexColor != 0 {
+				for i := 0; i < corners; i++ {
+					v, err := next()
+					if err != nil {
+						return nil, err
+					}
+					cl[i] = v
+				}
+				hasColor = true
+			}
+			if !hasColor {
+				if white < 0 {
+					white = len(obj.Colors)
+					obj.Colors = append(obj.Colors, 0xffffff)
+				}
+				for i := 0; i < corners; i++ {
+					cl[i] = uint32(white)
+				}
+			}
+		} else {
+			if tp&faceColor != 0 {
+				if err := skip(1); err != nil {
+					return nil, err
+				}
+			}
+			if tp&faceVertexColor != 0 {
+				if err := skip(corners); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		obj.addFace(corners, vt, nl, uv, cl, uint16(mtl), hasNormal, hasUv)
+	}
+
+	obj.Setup()
+	return obj, nil
+}
+
+func (obj *Binobj) addFace(corners int, vt, nl, uv [4]uint32, cl *[4]uint32, mtl uint16, hasNormal, hasUv bool) {
+	if corners == 3 {
+		v := [3]uint32{vt[0], vt[1], vt[2]}
+		n := [3]uint32{nl[0], nl[1], nl[2]}
+		u := [3]uint32{uv[0], uv[1], uv[2]}
+		var t *FlatTriangle
+		switch {
+		case hasNormal && hasUv:
+			st := &obj.SmoothUVTriangle
+			st.Normals = append(st.Normals, n)
+			st.Uvs = append(st.Uvs, u)
+			t = &st.FlatTriangle
+		case hasNormal:
+			st := &obj.SmoothTriangle
+			st.Normals = append(st.Normals, n)
+			t = &st.FlatTriangle
+		case hasUv:
+			st := &obj.FlatUVTriangle
+			st.Uvs = append(st.Uvs, u)
+			t = &st.FlatTriangle
+		default:
+			t = &obj.FlatTriangle
+		}
+		t.Vertices = append(t.Vertices, v)
+		t.Material = append(t.Material, mtl)
+		if cl != nil {
+			t.Colors = append(t.Colors, [3]uint32{cl[0], cl[1], cl[2]})
+		}
+		return
+	}
+
+	var q *FlatQuad
+	switch {
+	case hasNormal && hasUv:
+		sq := &obj.SmoothUVQuad
+		sq.Normals = append(sq.Normals, nl)
+		sq.Uvs = append(sq.Uvs, uv)
+		q = &sq.FlatQuad
+	case hasNormal:
+		sq := &obj.SmoothQuad
+		sq.Normals = append(sq.Normals, nl)
+		q = &sq.FlatQuad
+	case hasUv:
+		sq := &obj.FlatUVQuad
+		sq.Uvs = append(sq.Uvs, uv)
+		q = &sq.FlatQuad
+	default:
+		q = &obj.FlatQuad
+	}
+	q.Vertices = append(q.Vertices, vt)
+	q.Material = append(q.Material, mtl)
+	if cl != nil {
+		q.Colors = append(q.Colors, *cl)
+	}
+}
@@ -0,0 +1,124 @@
+package bin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/flywave/gltf"
+	mst "github.com/flywave/go-mst"
+)
+
+const cubeFaceJson = `{
+	"metadata": {"formatVersion": 3, "vertices": 4, "faces": 2},
+	"scale": 2.0,
+	"materials": [{"DbgName": "red", "colorDiffuse": [1, 0, 0], "opacity": 1}],
+	"vertices": [0, 0, 0, 2, 0, 0, 2, 2, 0, 0, 2, 0],
+	"normals": [0, 0, 1],
+	"uvs": [[0, 0, 1, 0, 1, 1, 0, 1]],
+	"faces": [
+		0, 0, 1, 2,
+		43, 0, 1, 2, 3, 0, 0, 1, 2, 3, 0, 0, 0, 0,
+		6, 0, 2, 3, 0, 2
+	]
+}`
+
+const colorFaceJson = `{
+	"vertices": [0, 0, 0, 1, 0, 0, 1, 1, 0, 0, 1, 0],
+	"colors": [16711680, 65280, 255],
+	"faces": [
+		64, 0, 1, 2, 0,
+		129, 0, 1, 2, 3, 0, 1, 2, 1,
+		0, 0, 2, 3
+	]
+}`
+
+func TestThreeJSModelColors(t *testing.T) {
+	_, obj, err := ThreeJSModelFromJson(strings.NewReader(colorFaceJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obj.Colors) != 4 || obj.Colors[3] != 0xffffff {
+		t.Fatalf("bad colors %v", obj.Colors)
+	}
+	tri := obj.FlatTriangle.Colors
+	if len(tri) != 2 || tri[0] != [3]uint32{0, 0, 0} || tri[1] != [3]uint32{3, 3, 3} {
+		t.Errorf("bad triangle colors %v", tri)
+	}
+	if len(obj.FlatQuad.Colors) != 1 || obj.FlatQuad.Colors[0] != [4]uint32{0, 1, 2, 1} {
+		t.Errorf("bad quad colors %v", obj.FlatQuad.Colors)
+	}
+	if fds := obj.ValidateMaterials(1); len(fds) != 0 {
+		t.Errorf("unexpected findings %v", fds)
+	}
+	obj.FlatQuad.Colors[0][3] = 9
+	if fds := obj.ValidateMaterials(1); len(fds) != 1 || fds[0].Kind != FindingColorIndex || !fds[0].Kind.Fatal() {
+		t.Errorf("color index not reported %v", fds)
+	}
+
+	mh, err := ThreejsBin2MstFS(fstest.MapFS{"color.json": &fstest.MapFile{Data: []byte(colorFaceJson)}}, "color.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd := mh.Nodes[0]
+	if len(nd.Colors) != len(nd.Vertices) || nd.Colors[0] != [3]byte{0xff, 0, 0} {
+		t.Fatalf("bad node colors %v", nd.Colors)
+	}
+
+	doc := mst.CreateDoc()
+	if err := BuildGltf(doc, mh); err != nil {
+		t.Fatal(err)
+	}
+	acc, ok := doc.Meshes[0].Primitives[0].Attributes[gltf.COLOR_0]
+	if !ok || doc.Accessors[acc].Count != uint32(len(nd.Colors)) {
+		t.Errorf("COLOR_0 missing")
+	}
+	if _, err := mst.GetGltfBinary(doc, 8); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestThreeJSModelFromJson(t *testing.T) {
+	ts, obj, err := ThreeJSModelFromJson(strings.NewReader(cubeFaceJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj == nil {
+		t.Fatal("inline model not decoded")
+	}
+	if obj.Vectilers[1] != [3]float32{1, 0, 0} {
+		t.Errorf("scale not applied %v", obj.Vectilers[1])
+	}
+	if obj.Normals[0] != [3]int8{0, 0, 127} {
+		t.Errorf("bad normal %v", obj.Normals[0])
+	}
+	if len(obj.FlatTriangle.Vertices) != 1 || len(obj.SmoothUVQuad.Vertices) != 1 {
+		t.Fatalf("bad buckets %d %d", len(obj.FlatTriangle.Vertices), len(obj.SmoothUVQuad.Vertices))
+	}
+	if obj.SmoothUVQuad.Uvs[0] != [4]uint32{0, 1, 2, 3} || obj.SmoothUVQuad.Normals[0] != [4]uint32{0, 0, 0, 0} {
+		t.Errorf("bad quad %v", obj.SmoothUVQuad)
+	}
+	if len(obj.FlatUVTriangle.Uvs) != 1 || obj.FlatUVTriangle.Uvs[0] != [3]uint32{2, 2, 2} {
+		t.Errorf("bad face uv %v", obj.FlatUVTriangle)
+	}
+	if obj.Header.QuadSmoothUVCount != 1 || len(ts.Materials) != 1 {
+		t.Errorf("header not setup")
+	}
+}
+
+func TestThreejsJson2Mst(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "model.json")
+	if err := os.WriteFile(fpath, []byte(cubeFaceJson), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	mh, err := ThreejsBin2Mst(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mh.Nodes) != 1 || len(mh.Nodes[0].FaceGroup[0].Faces) != 4 {
+		t.Errorf("unexpected mesh %v", mh.Nodes)
+	}
+}
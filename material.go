@@ -1,7 +1,10 @@
 package bin
 
 import (
+	"math"
 	"math/rand"
+	"path"
+	"strings"
 )
 
 var keyMap = map[string]string{
@@ -47,6 +50,26 @@ type Material struct {
 	MapAlpha       string    `json:"mapAlpha,omitempty"`
 	MapBump        string    `json:"mapBump,omitempty"`
 	Illumination   uint32    `json:"illumination"`
+
+	MapDiffuseRepeat []float64 `json:"mapDiffuseRepeat,omitempty"`
+	MapDiffuseOffset []float64 `json:"mapDiffuseOffset,omitempty"`
+	MapBumpScale     float64   `json:"mapBumpScale,omitempty"`
+}
+
+// maps points at every texture file name of m.
+func (m *Material) maps() []*string {
+	return []*string{&m.MapDiffuse, &m.MapAmbient, &m.MapEmissive, &m.MapSpecular, &m.MapAlpha, &m.MapBump}
+}
+
+// RebaseMaps puts the relative slash separated directory dir in front of
+// every relative texture path of m, for a material read from one directory
+// and written to another. Absolute paths are kept.
+func (m *Material) RebaseMaps(dir string) {
+	for _, mp := range m.maps() {
+		if *mp != "" && !path.IsAbs(*mp) {
+			*mp = path.Join(dir, strings.ReplaceAll(*mp, "\\", "/"))
+		}
+	}
 }
 
 func GenerateColor(i int) uint32 {
@@ -55,3 +78,72 @@ func GenerateColor(i int) uint32 {
 	}
 	return uint32(0xffffff * rand.Float32())
 }
+
+// dielectricSpecular is the reflectance of common non-metals at normal incidence.
+const dielectricSpecular = 0.04
+
+// PbrFactors converts the Phong parameters of the material into a
+// metallic-roughness base color, metalness and roughness.
+//
+// Roughness follows the usual Blinn-Phong to GGX mapping sqrt(2/(Ns+2)), so a
+// missing or zero SpecularCoef is fully rough. Metalness and base color are
+// solved from the diffuse and specular colors the same way the
+// KHR_materials_pbrSpecularGlossiness reference converter does: specular
+// reflectance at or below 4% is a pure dielectric, brighter specular colors
+// move toward metal and tint the base color. Illumination model 1 has no
+// highlight and always comes out as a rough dielectric; 0 is treated as unset
+// because most exporters leave it out. Only the colors are used; Convert
+// folds the average of a specular map into ColorSpecular first.
+func (m *Material) PbrFactors() (base [3]float64, metallic, roughness float64) {
+	diffuse := [3]float64{1, 1, 1}
+	if len(m.ColorDiffuse) >= 3 {
+		copy(diffuse[:], m.ColorDiffuse)
+	}
+	var specular [3]float64
+	if len(m.ColorSpecular) >= 3 {
+		copy(specular[:], m.ColorSpecular)
+	}
+	if m.Illumination == 1 {
+		specular = [3]float64{}
+	}
+
+	roughness = 1
+	if m.SpecularCoef > 0 && specular != [3]float64{} {
+		roughness = math.Sqrt(2 / (m.SpecularCoef + 2))
+	}
+
+	oneMinusSpecular := 1 - math.Max(specular[0], math.Max(specular[1], specular[2]))
+	metallic = solveMetallic(perceivedBrightness(diffuse), perceivedBrightness(specular), oneMinusSpecular)
+
+	// Unlike the reference converter a Phong diffuse color already is the
+	// visible color, so it is only darkened once the specular outweighs a
+	// dielectric's.
+	diffuseScale := math.Min(1, oneMinusSpecular/(1-dielectricSpecular))
+	const eps = 1e-6
+	for i := range base {
+		fromDiffuse := diffuse[i] * diffuseScale / math.Max(1-metallic, eps)
+		fromSpecular := (specular[i] - dielectricSpecular*(1-metallic)) / math.Max(metallic, eps)
+		t := metallic * metallic
+		base[i] = clamp01(fromDiffuse + (fromSpecular-fromDiffuse)*t)
+	}
+	return base, metallic, roughness
+}
+
+func perceivedBrightness(c [3]float64) float64 {
+	return math.Sqrt(0.299*c[0]*c[0] + 0.587*c[1]*c[1] + 0.114*c[2]*c[2])
+}
+
+func solveMetallic(diffuse, specular, oneMinusSpecular float64) float64 {
+	if specular < dielectricSpecular {
+		return 0
+	}
+	a := dielectricSpecular
+	b := diffuse*oneMinusSpecular/(1-dielectricSpecular) + specular - 2*dielectricSpecular
+	c := dielectricSpecular - specular
+	d := b*b - 4*a*c
+	return clamp01((-b + math.Sqrt(d)) / (2 * a))
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -1,6 +1,8 @@
 package bin
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
@@ -9,67 +11,211 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/fs"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/flywave/gltf"
 	mst "github.com/flywave/go-mst"
-	"github.com/flywave/go3d/mat4"
-	"github.com/flywave/go3d/quaternion"
+	dmat "github.com/flywave/go3d/float64/mat4"
+	dvec3 "github.com/flywave/go3d/float64/vec3"
 	"github.com/flywave/go3d/vec2"
 	"github.com/flywave/go3d/vec3"
-	"github.com/flywave/go3d/vec4"
 	"golang.org/x/image/bmp"
 )
 
 func ThreejsBin2Mst(fpath string) (*mst.Mesh, error) {
-	f, err := os.Open(fpath)
+	fsys, name, err := RootFS(fpath)
 	if err != nil {
 		return nil, err
 	}
+	return ThreejsBin2MstFS(fsys, name)
+}
 
-	jsobj, err := ThreeJSObjFromJson(f)
+// RootFS opens the file system root for fpath, so models may reference
+// buffers and textures in parent directories, and returns the name of fpath
+// in it.
+func RootFS(fpath string) (fs.FS, string, error) {
+	abs, err := filepath.Abs(fpath)
 	if err != nil {
-		fmt.Println(err.Error())
+		return nil, "", err
 	}
+	root := filepath.VolumeName(abs) + string(filepath.Separator)
+	return os.DirFS(root), filepath.ToSlash(abs[len(root):]), nil
+}
 
-	mesh := mst.NewMesh()
-	nd := &mst.MeshNode{}
+func resolvePath(dir, name string) string {
+	return path.Join(dir, strings.ReplaceAll(name, "\\", "/"))
+}
+
+func ThreejsBin2MstFS(fsys fs.FS, name string) (*mst.Mesh, error) {
+	res, err := Convert(fsys, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Mesh, nil
+}
 
-	binpath, _ := filepath.Split(fpath)
-	binpath = filepath.Join(binpath, jsobj.BinBuffer)
-	bf, _ := os.Open(binpath)
-	binobj, _ := Decode(bf)
+// AnchorsPath is the file next to the .mst at fpath that keeps its anchors,
+// model.anchors.json for model.mst.
+func AnchorsPath(fpath string) string {
+	return strings.TrimSuffix(fpath, filepath.Ext(fpath)) + ".anchors.json"
+}
 
-	var sc float32 = 1
-	rot := jsobj.Topology.Rotation
-	var quat quaternion.T
-	if len(rot) != 0 {
-		quat = quaternion.FromVec4(&vec4.T{float32(rot[0]), float32(rot[1]), float32(rot[2]), float32(rot[3])})
+// WriteAnchors writes the anchors of the .mst at fpath to AnchorsPath as a
+// json array, or removes a stale one when there are none.
+func WriteAnchors(fpath string, anchors []Anchor) error {
+	apath := AnchorsPath(fpath)
+	if len(anchors) == 0 {
+		err := os.Remove(apath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	bt, err := json.Marshal(anchors)
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(apath, bt, 0644)
+}
 
-	if jsobj.Topology.Scale != 0 {
-		sc = float32(jsobj.Topology.Scale)
+// ReadAnchors reads the anchors written by WriteAnchors for the .mst at
+// fpath, nil when it has none.
+func ReadAnchors(fpath string) ([]Anchor, error) {
+	bt, err := os.ReadFile(AnchorsPath(fpath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
-	off := vec3.T{}
-	if len(jsobj.Topology.Offset) != 0 {
-		of := jsobj.Topology.Offset
-		off = vec3.T{float32(of[0]), float32(of[1]), float32(of[2])}
+	var anchors []Anchor
+	if err := json.Unmarshal(bt, &anchors); err != nil {
+		return nil, fmt.Errorf("%s: %w", AnchorsPath(fpath), err)
 	}
-	mat := mat4.Compose(&off, &quat, &vec3.T{sc, sc, sc})
-	for i := range binobj.Vectilers {
-		v := (*vec3.T)(&binobj.Vectilers[i])
-		v1 := mat.MulVec3(v)
-		nd.Vertices = append(nd.Vertices, v1)
+	return anchors, nil
+}
+
+type ConvertOptions struct {
+	// CollectWarnings reports missing textures and out of range material
+	// indices in ConvertResult.Warnings instead of failing the conversion.
+	// Maps reduced to a color are reported either way.
+	CollectWarnings bool
+	// KeepTransform leaves vertices and normals in model space and stores
+	// the topology transform in the node matrix instead.
+	KeepTransform bool
+}
+
+type ConvertResult struct {
+	Mesh *mst.Mesh
+	Doc  *gltf.Document
+	// Anchors are the topology anchors after the topology transform, whether
+	// it is baked or kept in the node matrix; mst.Mesh has no place to keep
+	// them, see WriteAnchors.
+	Anchors []Anchor
+	// Bounds and Sphere enclose the vertices after the topology transform.
+	Bounds   Box
+	Sphere   Sphere
+	Warnings []error
+}
+
+func (r *ConvertResult) warn(opts *ConvertOptions, err error) error {
+	if opts == nil || !opts.CollectWarnings {
+		return err
 	}
+	r.Warnings = append(r.Warnings, err)
+	return nil
+}
+
+func (r *ConvertResult) validate(obj *Binobj, name string, opts *ConvertOptions) error {
+	for _, fd := range obj.Validate() {
+		if fd.Kind.Fatal() {
+			return &ConvertError{Kind: ErrCorruptBuffer, Path: name, Err: fd}
+		}
+		if opts != nil && opts.CollectWarnings {
+			r.Warnings = append(r.Warnings, fd)
+		}
+	}
+	return nil
+}
+
+// ThreeJSModelFromFS reads the model json at name and the binary buffer it
+// references, resolved relative to the json.
+func ThreeJSModelFromFS(fsys fs.FS, name string) (*ThreeJSObj, *Binobj, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	jsobj, binobj, err := ThreeJSModelFromJson(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if binobj == nil {
+		binpath := resolvePath(path.Dir(name), jsobj.BinBuffer)
+		bf, err := fsys.Open(binpath)
+		if err != nil {
+			return nil, nil, &ConvertError{Kind: ErrMissingBuffer, Path: binpath, Err: err}
+		}
+		binobj, err = Decode(bf)
+		bf.Close()
+		if err != nil {
+			return nil, nil, &ConvertError{Kind: ErrCorruptBuffer, Path: binpath, Err: err}
+		}
+	}
+	return jsobj, binobj, nil
+}
+
+// Convert reads the model json name from fsys into an mst mesh with one PBR
+// material per model material. mst.PbrMaterial only has slots for a diffuse
+// texture and a normal map, so specular, emissive and ambient maps are
+// reduced to their average color, scaling the specular and emissive colors
+// and setting the ambient occlusion, with an ErrAveragedMap warning each;
+// ThreejsToGltf keeps them as textures. ColorAmbient is not used.
+func Convert(fsys fs.FS, name string, opts *ConvertOptions) (*ConvertResult, error) {
+	jsobj, binobj, err := ThreeJSModelFromFS(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ConvertResult{}
+	if err := res.validate(binobj, name, opts); err != nil {
+		return nil, err
+	}
+	mesh := mst.NewMesh()
+	nd := &mst.MeshNode{}
+	dir := path.Dir(name)
+
+	mat := jsobj.Topology.Transform()
+	bake := mat != dmat.Ident && (opts == nil || !opts.KeepTransform)
+	if !bake && mat != dmat.Ident {
+		nd.Mat = &mat
+	}
+	nmat := mat.Inverted()
+	nmat.Transpose()
+	for _, v := range binobj.Vectilers {
+		if bake {
+			p := mat.MulVec3(&dvec3.T{float64(v[0]), float64(v[1]), float64(v[2])})
+			v = [3]float32{float32(p[0]), float32(p[1]), float32(p[2])}
+		}
+		nd.Vertices = append(nd.Vertices, vec3.T(v))
+	}
+	res.Anchors = jsobj.Topology.WorldAnchors()
+	res.Bounds, res.Sphere = binobj.Bounds(&jsobj.Topology)
 
 	if len(binobj.Normals) > 0 {
-		for i := range binobj.Normals {
-			nl := &vec3.T{float32(binobj.Normals[i][0] / 127), float32(binobj.Normals[i][1] / 127), float32(binobj.Normals[i][2] / 127)}
-			if nl.IsZero() {
-				nl[2] = 1
+		for _, nl := range binobj.GetDecodedNormals() {
+			if bake {
+				p := nmat.MulVec3W(&dvec3.T{float64(nl[0]), float64(nl[1]), float64(nl[2])}, 0)
+				p.Normalize()
+				nl = [3]float32{float32(p[0]), float32(p[1]), float32(p[2])}
 			}
-			nd.Normals = append(nd.Normals, *nl)
+			nd.Normals = append(nd.Normals, vec3.T(nl))
 		}
 	}
 
@@ -87,165 +233,179 @@ func ThreejsBin2Mst(fpath string) (*mst.Mesh, error) {
 		g.Batchid = int32(i)
 		nd.FaceGroup[i] = g
 	}
-	if binobj.Header.TriFlatCount > 0 {
-		mtls := binobj.FlatTriangle.Material
-		for i, id := range mtls {
-			g := nd.FaceGroup[int(id)]
-			f := &mst.Face{
-				Vertex: binobj.FlatTriangle.Vertices[i],
-			}
-			g.Faces = append(g.Faces, f)
+	faceColors := make(map[*mst.Face][3]uint32)
+	var fallback *mst.MeshTriangle
+	group := func(bucket string, face int, id uint16) (*mst.MeshTriangle, error) {
+		if int(id) < mtlcount {
+			return nd.FaceGroup[int(id)], nil
 		}
-	}
-	if binobj.Header.TriFlatUVCount > 0 {
-		mtls := binobj.FlatUVTriangle.Material
-		for i, id := range mtls {
-			g := nd.FaceGroup[int(id)]
-			f := &mst.Face{
-				Vertex: binobj.FlatUVTriangle.Vertices[i],
-				Uv:     &binobj.FlatUVTriangle.Uvs[i],
-			}
-			g.Faces = append(g.Faces, f)
+		err := res.warn(opts, &ConvertError{Kind: ErrMaterialIndex, Path: name, Err: fmt.Errorf("%s face %d uses material %d of %d", bucket, face, id, mtlcount)})
+		if err != nil {
+			return nil, err
 		}
-	}
-
-	if binobj.Header.TriSmoothCount > 0 {
-		mtls := binobj.SmoothTriangle.Material
-		for i, id := range mtls {
-			g := nd.FaceGroup[int(id)]
-			f := &mst.Face{
-				Vertex: binobj.SmoothTriangle.Vertices[i],
-				Normal: &binobj.SmoothTriangle.Normals[i],
-			}
-			g.Faces = append(g.Faces, f)
+		if fallback == nil {
+			fallback = &mst.MeshTriangle{Batchid: int32(mtlcount)}
+			nd.FaceGroup = append(nd.FaceGroup, fallback)
 		}
+		return fallback, nil
 	}
-
-	if binobj.Header.TriSmoothUVCount > 0 {
-		mtls := binobj.SmoothUVTriangle.Material
-		for i, id := range mtls {
-			g := nd.FaceGroup[int(id)]
-			f := &mst.Face{
-				Vertex: binobj.SmoothUVTriangle.Vertices[i],
-				Uv:     &binobj.SmoothUVTriangle.Uvs[i],
-				Normal: &binobj.SmoothUVTriangle.Normals[i],
+	var g *mst.MeshTriangle
+	for t := range binobj.Triangles() {
+		// both halves of a quad share the group and a single warning
+		if t.Half == 0 {
+			var err error
+			if g, err = group(t.Bucket.String(), t.Face, t.Material); err != nil {
+				return nil, err
 			}
-			g.Faces = append(g.Faces, f)
 		}
-	}
-
-	if binobj.Header.QuadFlatCount > 0 {
-		mtls := binobj.FlatQuad.Material
-		for i, id := range mtls {
-			vt := binobj.FlatQuad.Vertices[i]
-
-			g := nd.FaceGroup[int(id)]
-			f := &mst.Face{
-				Vertex: [3]uint32{vt[0], vt[1], vt[2]},
-			}
-			g.Faces = append(g.Faces, f)
-			f = &mst.Face{
-				Vertex: [3]uint32{vt[2], vt[3], vt[0]},
-			}
-			g.Faces = append(g.Faces, f)
+		f := &mst.Face{Vertex: t.Vertices, Normal: t.Normals, Uv: t.Uvs}
+		g.Faces = append(g.Faces, f)
+		if t.Colors != nil {
+			faceColors[f] = *t.Colors
 		}
 	}
 
-	if binobj.Header.QuadFlatUVCount > 0 {
-		mtls := binobj.FlatUVQuad.Material
-		for i, id := range mtls {
-			vt := binobj.FlatUVQuad.Vertices[i]
-			uv := binobj.FlatUVQuad.Uvs[i]
-
-			g := nd.FaceGroup[int(id)]
-			f := &mst.Face{
-				Vertex: [3]uint32{vt[0], vt[1], vt[2]},
-				Uv:     &[3]uint32{uv[0], uv[1], uv[2]},
-			}
-			g.Faces = append(g.Faces, f)
-			f = &mst.Face{
-				Vertex: [3]uint32{vt[2], vt[3], vt[0]},
-				Uv:     &[3]uint32{uv[2], uv[3], uv[0]},
-			}
-			g.Faces = append(g.Faces, f)
+	texture := func(name string, load func(path string) error) error {
+		ph := resolvePath(dir, name)
+		if err := load(ph); err != nil {
+			return res.warn(opts, &ConvertError{Kind: ErrMissingTexture, Path: ph, Err: err})
 		}
+		return nil
 	}
-
-	if binobj.Header.QuadSmoothCount > 0 {
-		mtls := binobj.SmoothQuad.Material
-		for i, id := range mtls {
-			vt := binobj.SmoothQuad.Vertices[i]
-			nl := binobj.SmoothQuad.Normals[i]
-
-			g := nd.FaceGroup[int(id)]
-			f := &mst.Face{
-				Vertex: [3]uint32{vt[0], vt[1], vt[2]},
-				Normal: &[3]uint32{nl[0], nl[1], nl[2]},
-			}
-			g.Faces = append(g.Faces, f)
-			f = &mst.Face{
-				Vertex: [3]uint32{vt[2], vt[3], vt[0]},
-				Normal: &[3]uint32{nl[2], nl[3], nl[0]},
-			}
-			g.Faces = append(g.Faces, f)
-		}
-	}
-
-	if binobj.Header.QuadSmoothUVCount > 0 {
-		mtls := binobj.SmoothUVQuad.Material
-		for i, id := range mtls {
-			vt := binobj.SmoothUVQuad.Vertices[i]
-			nl := binobj.SmoothUVQuad.Normals[i]
-			uv := binobj.SmoothUVQuad.Uvs[i]
-
-			g := nd.FaceGroup[int(id)]
-			f := &mst.Face{
-				Vertex: [3]uint32{vt[0], vt[1], vt[2]},
-				Normal: &[3]uint32{nl[0], nl[1], nl[2]},
-				Uv:     &[3]uint32{uv[0], uv[1], uv[2]},
-			}
-			g.Faces = append(g.Faces, f)
-			f = &mst.Face{
-				Vertex: [3]uint32{vt[2], vt[3], vt[0]},
-				Normal: &[3]uint32{nl[2], nl[3], nl[0]},
-				Uv:     &[3]uint32{uv[2], uv[3], uv[0]},
+	average := func(name string, ret func(avg [3]float64)) error {
+		return texture(name, func(ph string) error {
+			avg, err := averageColor(fsys, ph)
+			if err != nil {
+				return err
 			}
-			g.Faces = append(g.Faces, f)
-		}
+			ret(avg)
+			res.Warnings = append(res.Warnings, &ConvertError{Kind: ErrAveragedMap, Path: ph})
+			return nil
+		})
 	}
-
 	for id, mtl := range jsobj.Materials {
-		ml := &mst.PbrMaterial{Roughness: 1, Metallic: 0}
-		if len(mtl.ColorDiffuse) != 0 {
-			ml.Color[0] = byte(mtl.ColorDiffuse[0] * 255.0)
-			ml.Color[1] = byte(mtl.ColorDiffuse[1] * 255.0)
-			ml.Color[2] = byte(mtl.ColorDiffuse[2] * 255.0)
+		if mtl.MapSpecular != "" {
+			err := average(mtl.MapSpecular, func(avg [3]float64) {
+				mtl.ColorSpecular = scaleColor(mtl.ColorSpecular, avg)
+			})
+			if err != nil {
+				return nil, err
+			}
 		}
+		base, metallic, roughness := mtl.PbrFactors()
+		ml := &mst.PbrMaterial{Metallic: float32(metallic), Roughness: float32(roughness)}
+		ml.Color = colorBytes(base[:])
 		ml.Transparency = 1 - float32(mtl.Opacity)
 		if ml.Transparency == 1 {
 			ml.Transparency = 0
 		}
 
+		emissive := mtl.ColorEmissive
+		if mtl.MapEmissive != "" {
+			err := average(mtl.MapEmissive, func(avg [3]float64) {
+				emissive = scaleColor(emissive, avg)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(emissive) >= 3 {
+			ml.Emissive = colorBytes(emissive)
+		}
+
+		if mtl.MapAmbient != "" {
+			err := average(mtl.MapAmbient, func(avg [3]float64) {
+				ml.AmbientOcclusion = float32(perceivedBrightness(avg))
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		if mtl.MapDiffuse != "" {
-			dir, _ := filepath.Split(fpath)
 			var ap *string
 			if mtl.MapAlpha != "" {
-				ph := filepath.Join(dir, mtl.MapAlpha)
+				ph := resolvePath(dir, mtl.MapAlpha)
 				ap = &ph
 			}
-			tex, err := convertTex(filepath.Join(dir, mtl.MapDiffuse), ap, id)
-			if err == nil {
-				ml.Texture = tex
+			err := texture(mtl.MapDiffuse, func(ph string) (err error) {
+				ml.Texture, err = convertTex(fsys, ph, ap, id)
+				if err == nil {
+					for _, r := range mtl.MapDiffuseRepeat {
+						if r != 1 {
+							ml.Texture.Repeated = true
+						}
+					}
+				}
+				return err
+			})
+			if err != nil {
+				return nil, err
 			}
 		}
 
+		if mtl.MapBump != "" {
+			err := texture(mtl.MapBump, func(ph string) (err error) {
+				scale := mtl.MapBumpScale
+				if scale == 0 {
+					scale = 1
+				}
+				ml.Normal, err = convertBump(fsys, ph, scale, mtlcount+id)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		mesh.Materials = append(mesh.Materials, ml)
+	}
+	if fallback != nil {
+		ml := &mst.PbrMaterial{Roughness: 1}
+		ml.Color = [3]byte{0xee, 0xee, 0xee}
 		mesh.Materials = append(mesh.Materials, ml)
 	}
 
+	if bake && mat.Determinant3x3() < 0 {
+		// a mirroring transform turns the faces inside out
+		for _, g := range nd.FaceGroup {
+			for _, f := range g.Faces {
+				f.Vertex[1], f.Vertex[2] = f.Vertex[2], f.Vertex[1]
+				if f.Normal != nil {
+					f.Normal[1], f.Normal[2] = f.Normal[2], f.Normal[1]
+				}
+				if f.Uv != nil {
+					f.Uv[1], f.Uv[2] = f.Uv[2], f.Uv[1]
+				}
+				if cl, ok := faceColors[f]; ok {
+					faceColors[f] = [3]uint32{cl[0], cl[2], cl[1]}
+				}
+			}
+		}
+	}
 	nd.ResortVtVn(mesh)
 	// nd.ReComputeNormal()
+	if len(faceColors) > 0 {
+		for _, g := range nd.FaceGroup {
+			for _, f := range g.Faces {
+				cl, ok := faceColors[f]
+				for k := range cl {
+					if ok {
+						nd.Colors = append(nd.Colors, hexColor(binobj.Colors[cl[k]]))
+					} else {
+						nd.Colors = append(nd.Colors, [3]byte{0xff, 0xff, 0xff})
+					}
+				}
+			}
+		}
+	}
 	mesh.Nodes = append(mesh.Nodes, nd)
-	return mesh, nil
+	res.Mesh = mesh
+	return res, nil
+}
+
+func hexColor(c uint32) [3]byte {
+	return [3]byte{byte(c >> 16), byte(c >> 8), byte(c)}
 }
 
 func readDir(root, path string, ext_filter []string) ([]string, error) {
@@ -281,14 +441,24 @@ func readDir(root, path string, ext_filter []string) ([]string, error) {
 	return res, nil
 }
 
-func convertTex(path string, alphPh *string, texId int) (*mst.Texture, error) {
-	img1, err := readImageByPath(path)
+func convertTex(fsys fs.FS, path string, alphPh *string, texId int) (*mst.Texture, error) {
+	img, err := diffuseImage(fsys, path, alphPh)
+	if err != nil {
+		return nil, err
+	}
+	return newTexture(path, img.Rect, img.Pix, texId), nil
+}
+
+// diffuseImage reads a diffuse map and takes its alpha from the red channel
+// of the alpha map when there is one.
+func diffuseImage(fsys fs.FS, path string, alphPh *string) (*image.NRGBA, error) {
+	img1, err := readImageByPath(fsys, path)
 	if err != nil {
 		return nil, err
 	}
 	var img2 image.Image
 	if alphPh != nil {
-		img2, err = readImageByPath(*alphPh)
+		img2, err = readImageByPath(fsys, *alphPh)
 	}
 	if err != nil {
 		return nil, err
@@ -308,6 +478,10 @@ func convertTex(path string, alphPh *string, texId int) (*mst.Texture, error) {
 			buf = append(buf, byte(r&0xff), byte(g&0xff), byte(b&0xff), byte(float32(a&0xff)*sc))
 		}
 	}
+	return &image.NRGBA{Pix: buf, Stride: bd.Dx() * 4, Rect: image.Rect(0, 0, bd.Dx(), bd.Dy())}, nil
+}
+
+func newTexture(path string, bd image.Rectangle, buf []byte, texId int) *mst.Texture {
 	_, name := filepath.Split(path)
 	name = strings.Replace(name, ".jpg", ".png", 1)
 	name = strings.Replace(name, ".jpeg", ".png", 1)
@@ -319,20 +493,111 @@ func convertTex(path string, alphPh *string, texId int) (*mst.Texture, error) {
 	t.Size = [2]uint64{uint64(bd.Dx()), uint64(bd.Dy())}
 	t.Compressed = mst.TEXTURE_COMPRESSED_ZLIB
 	t.Data = mst.CompressImage(buf)
-	return t, nil
+	return t
+}
+
+func convertBump(fsys fs.FS, path string, scale float64, texId int) (*mst.Texture, error) {
+	img, err := bumpImage(fsys, path, scale)
+	if err != nil {
+		return nil, err
+	}
+	return newTexture(path, img.Rect, img.Pix, texId), nil
+}
+
+// bumpImage turns a height map into a tangent space normal map with +Y up,
+// the convention glTF expects. scale is the height of a full white texel
+// step measured in texels.
+func bumpImage(fsys fs.FS, path string, scale float64) (*image.NRGBA, error) {
+	img, err := readImageByPath(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	bd := img.Bounds()
+	w, h := bd.Dx(), bd.Dy()
+	heights := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.GrayModel.Convert(img.At(bd.Min.X+x, bd.Min.Y+y)).(color.Gray)
+			heights[y*w+x] = float64(c.Y) / 255
+		}
+	}
+	at := func(x, y int) float64 {
+		x = min(max(x, 0), w-1)
+		y = min(max(y, 0), h-1)
+		return heights[y*w+x]
+	}
+
+	ret := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			n := dvec3.T{
+				-(at(x+1, y) - at(x-1, y)) * scale,
+				(at(x, y+1) - at(x, y-1)) * scale,
+				1,
+			}
+			n.Normalize()
+			ret.SetNRGBA(x, y, color.NRGBA{
+				R: byte(math.Round((n[0]*0.5 + 0.5) * 255)),
+				G: byte(math.Round((n[1]*0.5 + 0.5) * 255)),
+				B: byte(math.Round((n[2]*0.5 + 0.5) * 255)),
+				A: 0xff,
+			})
+		}
+	}
+	return ret, nil
 }
 
-func readImageByPath(path string) (image.Image, error) {
-	f, err := os.Open(path)
+func averageColor(fsys fs.FS, path string) ([3]float64, error) {
+	img, err := readImageByPath(fsys, path)
+	if err != nil {
+		return [3]float64{}, err
+	}
+	var sum [3]float64
+	bd := img.Bounds()
+	for y := bd.Min.Y; y < bd.Max.Y; y++ {
+		for x := bd.Min.X; x < bd.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum[0] += float64(r) / 0xffff
+			sum[1] += float64(g) / 0xffff
+			sum[2] += float64(b) / 0xffff
+		}
+	}
+	if n := float64(bd.Dx() * bd.Dy()); n > 0 {
+		sum[0], sum[1], sum[2] = sum[0]/n, sum[1]/n, sum[2]/n
+	}
+	return sum, nil
+}
+
+// scaleColor multiplies cl by the average color of a map; a missing color
+// counts as white so the map alone decides.
+func scaleColor(cl []float64, avg [3]float64) []float64 {
+	ret := []float64{avg[0], avg[1], avg[2]}
+	if len(cl) >= 3 {
+		for i := range ret {
+			ret[i] *= cl[i]
+		}
+	}
+	return ret
+}
+
+func colorBytes(cl []float64) [3]byte {
+	var ret [3]byte
+	for i := range ret {
+		ret[i] = byte(math.Round(clamp01(cl[i]) * 255))
+	}
+	return ret
+}
+
+func readImageByPath(fsys fs.FS, path string) (image.Image, error) {
+	buf, err := fs.ReadFile(fsys, path)
 	if err != nil {
 		return nil, err
 	}
-	_, ft, err := image.Decode(f)
+	_, ft, err := image.DecodeConfig(bytes.NewReader(buf))
 	if err != nil {
 		return nil, err
 	}
-	f.Seek(0, 0)
-	return readImage(f, ft)
+	return readImage(bytes.NewReader(buf), ft)
 }
 
 func readImage(rd io.Reader, ft string) (image.Image, error) {
@@ -349,3 +614,195 @@ func readImage(rd io.Reader, ft string) (image.Image, error) {
 		return nil, errors.New("unknow format")
 	}
 }
+
+func MstToThreejs(mh *mst.Mesh) (*ThreeJSObj, *Binobj, error) {
+	if mh == nil {
+		return nil, nil, errors.New("mesh is nil")
+	}
+	obj := &Binobj{}
+	for _, nd := range mh.Nodes {
+		vOff := uint32(len(obj.Vectilers))
+		nOff := uint32(len(obj.Normals))
+		uvOff := uint32(len(obj.UVs))
+		cOff := uint32(len(obj.Colors))
+		for _, c := range nd.Colors {
+			obj.Colors = append(obj.Colors, uint32(c[0])<<16|uint32(c[1])<<8|uint32(c[2]))
+		}
+
+		var mat, nmat *dmat.T
+		if nd.Mat != nil {
+			mat = nd.Mat
+			m := nd.Mat.Inverted()
+			m.Transpose()
+			nmat = &m
+		}
+		for _, v := range nd.Vertices {
+			if mat != nil {
+				p := mat.MulVec3(&dvec3.T{float64(v[0]), float64(v[1]), float64(v[2])})
+				v = vec3.T{float32(p[0]), float32(p[1]), float32(p[2])}
+			}
+			obj.Vectilers = append(obj.Vectilers, v)
+		}
+		for _, n := range nd.Normals {
+			if nmat != nil {
+				p := nmat.MulVec3W(&dvec3.T{float64(n[0]), float64(n[1]), float64(n[2])}, 0)
+				p.Normalize()
+				n = vec3.T{float32(p[0]), float32(p[1]), float32(p[2])}
+			}
+			obj.Normals = append(obj.Normals, EncodeNormal(n))
+		}
+		for _, uv := range nd.TexCoords {
+			obj.UVs = append(obj.UVs, [2]float32(uv))
+		}
+
+		for _, g := range nd.FaceGroup {
+			mtl := g.Batchid
+			if mtl < 0 {
+				mtl = 0
+			}
+			if int(mtl) >= len(mh.Materials) || mtl > math.MaxUint16 {
+				return nil, nil, fmt.Errorf("material index %d out of range", mtl)
+			}
+			for _, f := range g.Faces {
+				var vt, nl, uv [4]uint32
+				for i := 0; i < 3; i++ {
+					vt[i] = f.Vertex[i] + vOff
+					if f.Normal != nil {
+						nl[i] = f.Normal[i] + nOff
+					}
+					if f.Uv != nil {
+						uv[i] = f.Uv[i] + uvOff
+					}
+				}
+				var cl *[4]uint32
+				if len(nd.Colors) > 0 {
+					cl = &[4]uint32{f.Vertex[0] + cOff, f.Vertex[1] + cOff, f.Vertex[2] + cOff}
+				}
+				obj.addFace(3, vt, nl, uv, cl, uint16(mtl), f.Normal != nil && len(nd.Normals) > 0, f.Uv != nil && len(nd.TexCoords) > 0)
+			}
+		}
+	}
+	obj.Setup()
+
+	ts := &ThreeJSObj{}
+	ts.Metadata = newMetadata(obj, len(mh.Materials))
+	ts.Topology = identityTopology()
+	texNames := textureNames(mh)
+	for i, m := range mh.Materials {
+		ts.Materials = append(ts.Materials, mstToMaterial(m, i, texNames))
+	}
+	return ts, obj, nil
+}
+
+func mstToMaterial(m mst.MeshMaterial, i int, texNames map[*mst.Texture]string) Material {
+	mtl := Material{
+		DbgName:  fmt.Sprintf("material_%d", i),
+		DbgIndex: uint32(i),
+		DbgColor: GenerateColor(i),
+		Opacity:  1,
+	}
+	cl := m.GetColor()
+	mtl.ColorDiffuse = []float64{float64(cl[0]) / 255, float64(cl[1]) / 255, float64(cl[2]) / 255}
+	if em := m.GetEmissive(); em != [3]byte{} {
+		mtl.ColorEmissive = []float64{float64(em[0]) / 255, float64(em[1]) / 255, float64(em[2]) / 255}
+	}
+
+	switch ml := m.(type) {
+	case *mst.BaseMaterial:
+		mtl.Opacity = 1 - float64(ml.Transparency)
+	case *mst.TextureMaterial:
+		mtl.Opacity = 1 - float64(ml.Transparency)
+	case *mst.PbrMaterial:
+		mtl.Opacity = 1 - float64(ml.Transparency)
+	case *mst.LambertMaterial:
+		mtl.Opacity = 1 - float64(ml.Transparency)
+	case *mst.PhongMaterial:
+		mtl.Opacity = 1 - float64(ml.Transparency)
+		mtl.ColorSpecular = []float64{float64(ml.Specular[0]) / 255, float64(ml.Specular[1]) / 255, float64(ml.Specular[2]) / 255}
+		mtl.SpecularCoef = float64(ml.Shininess)
+	}
+
+	if m.HasTexture() {
+		mtl.MapDiffuse = texNames[m.GetTexture()]
+	}
+	return mtl
+}
+
+func textureName(tex *mst.Texture) string {
+	name := tex.Name
+	if name == "" {
+		name = fmt.Sprintf("texture_%d", tex.Id)
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".png"
+}
+
+// textureNames gives every texture of mh its own png file name, numbering
+// different textures that share a name.
+func textureNames(mh *mst.Mesh) map[*mst.Texture]string {
+	ret := make(map[*mst.Texture]string)
+	used := make(map[string]bool)
+	for _, m := range mh.Materials {
+		if !m.HasTexture() {
+			continue
+		}
+		tex := m.GetTexture()
+		if _, ok := ret[tex]; ok {
+			continue
+		}
+		name := textureName(tex)
+		base := strings.TrimSuffix(name, ".png")
+		for n := 1; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d.png", base, n)
+		}
+		used[name] = true
+		ret[tex] = name
+	}
+	return ret
+}
+
+func MstToThreejsBin(mh *mst.Mesh, fpath string) error {
+	ts, obj, err := MstToThreejs(mh)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(fpath)
+
+	for tex, tn := range textureNames(mh) {
+		img, err := mst.LoadTexture(tex, false)
+		if err != nil {
+			return err
+		}
+		tf, err := os.Create(filepath.Join(dir, tn))
+		if err != nil {
+			return err
+		}
+		err = png.Encode(tf, img)
+		tf.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return WriteThreejsBin(ts, obj, fpath)
+}
+
+// WriteThreejsBin writes the model json to fpath and the geometry to a .bin
+// next to it. Textures are only referenced, not copied.
+func WriteThreejsBin(ts *ThreeJSObj, obj *Binobj, fpath string) error {
+	dir, name := filepath.Split(fpath)
+	ts.BinBuffer = strings.TrimSuffix(name, filepath.Ext(name)) + ".bin"
+	if ts.Metadata.Source == "" {
+		ts.Metadata.Source = name
+	}
+
+	bf, err := os.Create(filepath.Join(dir, ts.BinBuffer))
+	if err != nil {
+		return err
+	}
+	err = Encode(bf, obj)
+	bf.Close()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fpath, []byte(ts.ToJson()), 0644)
+}
@@ -0,0 +1,329 @@
+package bin
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	mst "github.com/flywave/go-mst"
+	"github.com/flywave/go3d/vec2"
+	"github.com/flywave/go3d/vec3"
+)
+
+func testMstMesh(t *testing.T) *mst.Mesh {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	tex, err := mst.CreateTextureFromImage(img, "checker.jpg", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mh := mst.NewMesh()
+	plain := &mst.PbrMaterial{}
+	plain.Color = [3]byte{0, 255, 0}
+	textured := &mst.PbrMaterial{}
+	textured.Color = [3]byte{255, 255, 255}
+	textured.Transparency = 0.5
+	textured.Texture = tex
+	mh.Materials = append(mh.Materials, plain, textured)
+
+	nd := &mst.MeshNode{
+		Vertices:  []vec3.T{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}},
+		Normals:   []vec3.T{{0, 0, 1}},
+		TexCoords: []vec2.T{{0, 0}, {1, 0}, {1, 1}, {0, 1}},
+	}
+	nd.FaceGroup = []*mst.MeshTriangle{
+		{Batchid: 0, Faces: []*mst.Face{{Vertex: [3]uint32{0, 1, 2}}}},
+		{Batchid: 1, Faces: []*mst.Face{{Vertex: [3]uint32{0, 2, 3}, Normal: &[3]uint32{0, 0, 0}, Uv: &[3]uint32{0, 2, 3}}}},
+	}
+	mh.Nodes = append(mh.Nodes, nd)
+	return mh
+}
+
+func TestMstToThreejsBin(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "model.json")
+	if err := MstToThreejsBin(testMstMesh(t), fpath); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"model.json", "model.bin", "checker.png"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "model.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	obj, err := Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Header.TriFlatCount != 1 || obj.Header.TriSmoothUVCount != 1 {
+		t.Errorf("unexpected buckets %+v", obj.Header)
+	}
+	if obj.SmoothUVTriangle.Uvs[0] != [3]uint32{0, 2, 3} || obj.SmoothUVTriangle.Material[0] != 1 {
+		t.Errorf("unexpected face %v", obj.SmoothUVTriangle)
+	}
+
+	mh, err := ThreejsBin2Mst(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mh.Materials) != 2 || !mh.Materials[1].HasTexture() {
+		t.Errorf("materials not restored")
+	}
+	if len(mh.Nodes[0].FaceGroup[1].Faces) != 1 {
+		t.Errorf("faces not restored")
+	}
+}
+
+func TestMstTextureNames(t *testing.T) {
+	mh := testMstMesh(t)
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	tex, err := mst.CreateTextureFromImage(img, "checker.jpg", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, other := &mst.PbrMaterial{}, &mst.PbrMaterial{}
+	shared.Texture = mh.Materials[1].GetTexture()
+	other.Texture = tex
+	mh.Materials = append(mh.Materials, shared, other)
+
+	dir := t.TempDir()
+	if err := MstToThreejsBin(mh, filepath.Join(dir, "model.json")); err != nil {
+		t.Fatal(err)
+	}
+	ts, _, err := MstToThreejs(mh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"", "checker.png", "checker.png", "checker_1.png"} {
+		if got := ts.Materials[i].MapDiffuse; got != want {
+			t.Errorf("material %d: texture %q, want %q", i, got, want)
+		}
+	}
+	st, err := os.Stat(filepath.Join(dir, "checker_1.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm()&0111 != 0 {
+		t.Errorf("texture written executable: %v", st.Mode())
+	}
+}
+
+func TestThreejsBin2MstFS(t *testing.T) {
+	dir := t.TempDir()
+	if err := MstToThreejsBin(testMstMesh(t), filepath.Join(dir, "model.json")); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{}
+	for _, f := range []string{"model.json", "model.bin", "checker.png"} {
+		buf, err := os.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys["assets/pipe/"+f] = &fstest.MapFile{Data: buf}
+	}
+
+	mh, err := ThreejsBin2MstFS(fsys, "assets/pipe/model.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mh.Materials) != 2 || !mh.Materials[1].HasTexture() {
+		t.Errorf("texture not resolved from fs")
+	}
+	if len(mh.Nodes[0].Vertices) != 6 {
+		t.Errorf("unexpected vertices %d", len(mh.Nodes[0].Vertices))
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := MstToThreejsBin(testMstMesh(t), filepath.Join(dir, "model.json")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "model.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := os.ReadFile(filepath.Join(dir, "model.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{"model.json": &fstest.MapFile{Data: data}}
+	if _, err := Convert(fsys, "model.json", nil); !errors.Is(err, ErrMissingBuffer) {
+		t.Errorf("expected missing buffer, got %v", err)
+	}
+
+	fsys["model.bin"] = &fstest.MapFile{Data: bin[:70]}
+	if _, err := Convert(fsys, "model.json", nil); !errors.Is(err, ErrCorruptBuffer) {
+		t.Errorf("expected corrupt buffer, got %v", err)
+	}
+
+	fsys["model.bin"] = &fstest.MapFile{Data: bin}
+	if _, err := Convert(fsys, "model.json", nil); !errors.Is(err, ErrMissingTexture) {
+		t.Errorf("expected missing texture, got %v", err)
+	}
+	res, err := Convert(fsys, "model.json", &ConvertOptions{CollectWarnings: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 1 || !errors.Is(res.Warnings[0], ErrMissingTexture) {
+		t.Errorf("unexpected warnings %v", res.Warnings)
+	}
+}
+
+func TestConvertMaterialIndex(t *testing.T) {
+	fsys := fstest.MapFS{"model.json": &fstest.MapFile{Data: []byte(`{
+		"materials": [{"DbgName": "only", "opacity": 1}],
+		"vertices": [0, 0, 0, 1, 0, 0, 1, 1, 0],
+		"faces": [2, 0, 1, 2, 3]
+	}`)}}
+	if _, err := Convert(fsys, "model.json", nil); !errors.Is(err, ErrMaterialIndex) {
+		t.Errorf("expected material index error, got %v", err)
+	}
+	res, err := Convert(fsys, "model.json", &ConvertOptions{CollectWarnings: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 1 || len(res.Mesh.Materials) != 2 || len(res.Mesh.Nodes[0].FaceGroup[1].Faces) != 1 {
+		t.Errorf("face not moved to fallback material")
+	}
+}
+
+func TestConvertPhongMaterial(t *testing.T) {
+	pngData := func(c color.Color) []byte {
+		img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		for i := 0; i < 4; i++ {
+			img.Set(i, 1, c)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	fsys := fstest.MapFS{
+		"model.json": &fstest.MapFile{Data: []byte(`{
+			"materials": [
+				{"DbgName": "plastic", "colorDiffuse": [0.8, 0.2, 0.2], "colorSpecular": [0.04, 0.04, 0.04], "specularCoef": 98, "opacity": 1,
+				 "colorEmissive": [1, 0.5, 0], "mapBump": "bump.png"},
+				{"DbgName": "chrome", "colorDiffuse": [0, 0, 0], "colorSpecular": [1, 1, 1], "specularCoef": 1000, "opacity": 1,
+				 "mapEmissive": "glow.png", "illumination": 3},
+				{"DbgName": "matte", "colorDiffuse": [0.5, 0.5, 0.5], "colorSpecular": [1, 1, 1], "specularCoef": 50, "opacity": 1,
+				 "illumination": 1}
+			],
+			"vertices": [0, 0, 0, 1, 0, 0, 1, 1, 0],
+			"faces": [2, 0, 1, 2, 0]
+		}`)},
+		"bump.png": &fstest.MapFile{Data: pngData(color.White)},
+		"glow.png": &fstest.MapFile{Data: pngData(color.NRGBA{G: 255, A: 255})},
+	}
+	res, err := Convert(fsys, "model.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Warnings) != 1 || !errors.Is(res.Warnings[0], ErrAveragedMap) || !strings.Contains(res.Warnings[0].Error(), "glow.png") {
+		t.Errorf("averaged emissive map not reported %v", res.Warnings)
+	}
+	mh := res.Mesh
+
+	plastic := mh.Materials[0].(*mst.PbrMaterial)
+	if plastic.Metallic != 0 || math.Abs(float64(plastic.Roughness)-0.1414) > 1e-3 {
+		t.Errorf("bad plastic factors %v %v", plastic.Metallic, plastic.Roughness)
+	}
+	if plastic.Color != [3]byte{204, 51, 51} || plastic.Emissive != [3]byte{255, 128, 0} {
+		t.Errorf("bad plastic colors %v %v", plastic.Color, plastic.Emissive)
+	}
+	if plastic.Normal == nil || plastic.Normal.Id != 3 {
+		t.Fatal("bump map not converted")
+	}
+	img, err := mst.LoadTexture(plastic.Normal, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 != 128 || g>>8 != 218 || b>>8 != 218 {
+		t.Errorf("bad normal above a ridge %d %d %d", r>>8, g>>8, b>>8)
+	}
+
+	chrome := mh.Materials[1].(*mst.PbrMaterial)
+	if chrome.Metallic != 1 || chrome.Color != [3]byte{255, 255, 255} {
+		t.Errorf("bad chrome %v %v", chrome.Metallic, chrome.Color)
+	}
+	if chrome.Emissive != [3]byte{0, 64, 0} {
+		t.Errorf("emissive map not averaged %v", chrome.Emissive)
+	}
+
+	matte := mh.Materials[2].(*mst.PbrMaterial)
+	if matte.Metallic != 0 || matte.Roughness != 1 || matte.Color != [3]byte{128, 128, 128} {
+		t.Errorf("illum 1 should stay diffuse %v %v %v", matte.Metallic, matte.Roughness, matte.Color)
+	}
+}
+
+func TestConvertTopologyTransform(t *testing.T) {
+	convert := func(topology string, opts *ConvertOptions) *mst.MeshNode {
+		t.Helper()
+		js := strings.Replace(cubeFaceJson, "{", `{"topology": `+topology+`,`, 1)
+		res, err := Convert(fstest.MapFS{"model.json": &fstest.MapFile{Data: []byte(js)}}, "model.json", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Mesh.Nodes[0]
+	}
+	for topology, want := range map[string]vec3.T{
+		`{"rotation": [1.5707963267948966, 0, 0]}`: {0, -1, 0},
+		`{"scale": [2, 1, -1]}`:                    {0, 0, -1},
+	} {
+		nd := convert(topology, nil)
+		faces := 0
+		for _, g := range nd.FaceGroup {
+			for _, f := range g.Faces {
+				if f.Normal == nil {
+					continue
+				}
+				faces++
+				n := nd.Normals[f.Vertex[0]]
+				if vec3.Distance(&n, &want) > 1e-5 {
+					t.Errorf("%s: normal %v, want %v", topology, n, want)
+				}
+				a, b, c := nd.Vertices[f.Vertex[0]], nd.Vertices[f.Vertex[1]], nd.Vertices[f.Vertex[2]]
+				e1, e2 := vec3.Sub(&b, &a), vec3.Sub(&c, &a)
+				if cr := vec3.Cross(&e1, &e2); vec3.Dot(&cr, &n) <= 0 {
+					t.Errorf("%s: face %v winds against its normal", topology, f.Vertex)
+				}
+			}
+		}
+		if faces != 2 {
+			t.Errorf("%s: expected 2 faces with normals, got %d", topology, faces)
+		}
+	}
+
+	nd := convert(`{"scale": [2, 1, 1], "offset": [0, 0, 5]}`, &ConvertOptions{KeepTransform: true})
+	if nd.Mat == nil || nd.Mat[0][0] != 2 || nd.Mat[3][2] != 5 {
+		t.Fatalf("transform not kept %v", nd.Mat)
+	}
+	for _, v := range nd.Vertices {
+		if v[2] != 0 || v[0] > 1 {
+			t.Errorf("vertex transformed %v", v)
+		}
+	}
+	doc := mst.CreateDoc()
+	if err := BuildGltf(doc, &mst.Mesh{BaseMesh: mst.BaseMesh{Nodes: []*mst.MeshNode{nd}}}); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Nodes[0].Matrix[0] != 2 || doc.Nodes[0].Matrix[14] != 5 {
+		t.Errorf("node matrix not written %v", doc.Nodes[0].Matrix)
+	}
+}
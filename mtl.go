@@ -0,0 +1,326 @@
+package bin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// mapOptionArgs is the number of values each MTL texture option takes.
+var mapOptionArgs = map[string]int{
+	"-blendu":  1,
+	"-blendv":  1,
+	"-boost":   1,
+	"-bm":      1,
+	"-cc":      1,
+	"-clamp":   1,
+	"-imfchan": 1,
+	"-texres":  1,
+	"-type":    1,
+	"-mm":      2,
+	"-o":       3,
+	"-s":       3,
+	"-t":       3,
+}
+
+// mtlIgnored are the keyMap keys that mean something else in MTL files and
+// have no Material field: refl is a reflection map, not an illumination
+// model, and map_Ns a shininess map, not a specular one.
+var mtlIgnored = map[string]bool{"refl": true, "map_ns": true}
+
+// MaterialsFromMtl parses a Wavefront MTL file. Keys are looked up in keyMap,
+// anything it does not know and mtlIgnored are skipped. Tr is stored as
+// opacity 1-Tr, the same way d is.
+func MaterialsFromMtl(data io.Reader) ([]Material, error) {
+	var ret []Material
+	var cur *Material
+
+	sc := bufio.NewScanner(data)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		tokens := strings.Fields(stripMtlComment(text))
+		if len(tokens) == 0 {
+			continue
+		}
+		key := strings.ToLower(tokens[0])
+		args := tokens[1:]
+
+		if key == "newmtl" {
+			i := len(ret)
+			ret = append(ret, Material{
+				DbgName:  strings.Join(args, " "),
+				DbgIndex: uint32(i),
+				DbgColor: GenerateColor(i),
+				Opacity:  1,
+			})
+			cur = &ret[i]
+			continue
+		}
+		field, ok := keyMap[key]
+		if !ok || mtlIgnored[key] {
+			continue
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("line %d: %s before newmtl", line, tokens[0])
+		}
+		if err := cur.setMtl(key, field, args); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", line, tokens[0], err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (m *Material) setMtl(key, field string, args []string) error {
+	if strings.HasPrefix(field, "map") {
+		file, opts, err := parseMapArgs(args)
+		if err != nil {
+			return err
+		}
+		switch field {
+		case "mapDiffuse":
+			m.MapDiffuse = file
+			m.MapDiffuseRepeat = opts["-s"]
+			m.MapDiffuseOffset = opts["-o"]
+		case "mapAmbient":
+			m.MapAmbient = file
+		case "mapEmissive":
+			m.MapEmissive = file
+		case "mapSpecular":
+			m.MapSpecular = file
+		case "mapAlpha":
+			m.MapAlpha = file
+		case "mapBump":
+			m.MapBump = file
+			if bm := opts["-bm"]; len(bm) > 0 {
+				m.MapBumpScale = bm[0]
+			}
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(field, "color") {
+		cl, err := parseMtlColor(args)
+		if err != nil {
+			return err
+		}
+		switch field {
+		case "colorDiffuse":
+			m.ColorDiffuse = cl
+		case "colorAmbient":
+			m.ColorAmbient = cl
+		case "colorEmissive":
+			m.ColorEmissive = cl
+		case "colorSpecular":
+			m.ColorSpecular = cl
+		}
+		return nil
+	}
+
+	if key == "d" && len(args) > 0 && strings.EqualFold(args[0], "-halo") {
+		// halo opacity depends on the view angle, take the plain value
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return errors.New("missing value")
+	}
+	v, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return err
+	}
+	switch field {
+	case "specularCoef":
+		m.SpecularCoef = v
+	case "opacity":
+		if key == "tr" {
+			v = 1 - v
+		}
+		m.Opacity = v
+	case "opticalDensity":
+		m.OpticalDensity = v
+	case "illumination":
+		m.Illumination = uint32(v)
+	}
+	return nil
+}
+
+// stripMtlComment cuts text at a # that starts the line or follows
+// whitespace, so file names containing # are kept.
+func stripMtlComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t') {
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// parseMtlColor reads "r g b", a single grey value, or the "xyz" form, which
+// is converted from CIE XYZ to linear sRGB; the spectral form has no rgb
+// equivalent and yields nil.
+func parseMtlColor(args []string) ([]float64, error) {
+	if len(args) > 0 && strings.EqualFold(args[0], "spectral") {
+		return nil, nil
+	}
+	xyz := len(args) > 0 && strings.EqualFold(args[0], "xyz")
+	if xyz {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil, errors.New("missing color")
+	}
+	cl := make([]float64, 3)
+	for i := range cl {
+		s := args[0]
+		if i < len(args) {
+			s = args[i]
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		cl[i] = v
+	}
+	if xyz {
+		x, y, z := cl[0], cl[1], cl[2]
+		cl[0] = clamp01(3.2406*x - 1.5372*y - 0.4986*z)
+		cl[1] = clamp01(-0.9689*x + 1.8758*y + 0.0415*z)
+		cl[2] = clamp01(0.0557*x - 0.2040*y + 1.0570*z)
+	}
+	return cl, nil
+}
+
+// parseMapArgs splits the options in front of a texture file name from the
+// name itself, which may contain spaces. Unknown options are skipped along
+// with the numbers following them.
+func parseMapArgs(args []string) (string, map[string][]float64, error) {
+	opts := make(map[string][]float64)
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		opt := strings.ToLower(args[i])
+		n, ok := mapOptionArgs[opt]
+		i++
+		if !ok {
+			for i < len(args)-1 && isMtlNumber(args[i]) {
+				i++
+			}
+			continue
+		}
+		var vals []float64
+		for k := 0; k < n && i < len(args); k++ {
+			v, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				// -s, -o and -t take one to three numbers, the single
+				// value options may also be words such as on or l.
+				if k > 0 {
+					break
+				}
+				if n == 1 {
+					i++
+					break
+				}
+				return "", nil, fmt.Errorf("bad value %s for %s", args[i], opt)
+			}
+			vals = append(vals, v)
+			i++
+		}
+		opts[opt] = vals
+	}
+	if i >= len(args) {
+		return "", nil, errors.New("missing file name")
+	}
+	return strings.Join(args[i:], " "), opts, nil
+}
+
+func isMtlNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// mtlNames gives every material a unique name without whitespace, which is
+// what usemtl and newmtl refer to.
+func mtlNames(mtls []Material) []string {
+	ret := make([]string, len(mtls))
+	used := make(map[string]bool)
+	for i, m := range mtls {
+		base := strings.Join(strings.Fields(m.DbgName), "_")
+		if base == "" {
+			base = fmt.Sprintf("material_%d", i)
+		}
+		name := base
+		for n := 1; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d", base, n)
+		}
+		used[name] = true
+		ret[i] = name
+	}
+	return ret
+}
+
+// EncodeMtl writes mtls as a Wavefront MTL, the reverse of MaterialsFromMtl.
+func EncodeMtl(wr io.Writer, mtls []Material) error {
+	w := bufio.NewWriter(wr)
+	fmt.Fprintf(w, "# generated by go-3jsbin\n")
+	color := func(key string, cl []float64) {
+		if len(cl) >= 3 {
+			fmt.Fprintf(w, "%s %g %g %g\n", key, cl[0], cl[1], cl[2])
+		}
+	}
+	texture := func(key, file, opts string) {
+		if file != "" {
+			fmt.Fprintf(w, "%s %s%s\n", key, opts, file)
+		}
+	}
+	vector := func(opt string, v []float64) string {
+		if len(v) == 0 {
+			return ""
+		}
+		s := opt
+		for _, f := range v {
+			s += " " + strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return s + " "
+	}
+
+	names := mtlNames(mtls)
+	for i, m := range mtls {
+		fmt.Fprintf(w, "\nnewmtl %s\n", names[i])
+		color("Ka", m.ColorAmbient)
+		color("Kd", m.ColorDiffuse)
+		color("Ks", m.ColorSpecular)
+		color("Ke", m.ColorEmissive)
+		if m.SpecularCoef != 0 {
+			fmt.Fprintf(w, "Ns %g\n", m.SpecularCoef)
+		}
+		if m.OpticalDensity != 0 {
+			fmt.Fprintf(w, "Ni %g\n", m.OpticalDensity)
+		}
+		// Opacity 0 means unset, as in Convert and the glTF writer.
+		d := m.Opacity
+		if d <= 0 {
+			d = 1
+		}
+		fmt.Fprintf(w, "d %g\n", d)
+		if m.Illumination != 0 {
+			fmt.Fprintf(w, "illum %d\n", m.Illumination)
+		}
+		texture("map_Ka", m.MapAmbient, "")
+		texture("map_Kd", m.MapDiffuse, vector("-s", m.MapDiffuseRepeat)+vector("-o", m.MapDiffuseOffset))
+		texture("map_Ks", m.MapSpecular, "")
+		texture("map_Ke", m.MapEmissive, "")
+		texture("map_d", m.MapAlpha, "")
+		bm := ""
+		if m.MapBumpScale != 0 {
+			bm = vector("-bm", []float64{m.MapBumpScale})
+		}
+		texture("map_bump", m.MapBump, bm)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,84 @@
+package bin
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+const testMtl = `# exported
+newmtl brick wall
+Ka 0.1
+Kd 0.8 0.4 0.2
+Ks xyz 0.9505 1 1.089
+Ke spectral glow.rfl
+Ns 96.0
+Tr 0.25
+illum 2
+map_Kd -s 2 2 1 -o 0.5 0 -clamp on textures/brick diffuse.jpg
+map_bump -bm 0.3 -imfchan l brick_bump.png
+refl -type sphere -mm 0 1 chrome.png
+map_Ks -halo 0.5 1 -clamp on spec.png
+map_Ns shiny.png
+
+newmtl glass
+d -halo 0.4
+map_d alpha#2.png # inverted
+`
+
+func TestMaterialsFromMtl(t *testing.T) {
+	mtls, err := MaterialsFromMtl(strings.NewReader(testMtl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mtls) != 2 {
+		t.Fatalf("expected 2 materials, got %d", len(mtls))
+	}
+	brick := mtls[0]
+	if brick.DbgName != "brick wall" || brick.DbgIndex != 0 {
+		t.Errorf("bad name %q", brick.DbgName)
+	}
+	if len(brick.ColorAmbient) != 3 || brick.ColorAmbient[2] != 0.1 || brick.ColorDiffuse[1] != 0.4 || math.Abs(brick.ColorSpecular[0]-1) > 1e-3 || math.Abs(brick.ColorSpecular[2]-1) > 1e-3 {
+		t.Errorf("bad colors %v %v %v", brick.ColorAmbient, brick.ColorDiffuse, brick.ColorSpecular)
+	}
+	if brick.ColorEmissive != nil {
+		t.Errorf("spectral color should be dropped")
+	}
+	if brick.SpecularCoef != 96 || brick.Opacity != 0.75 || brick.Illumination != 2 {
+		t.Errorf("bad scalars %v %v %v", brick.SpecularCoef, brick.Opacity, brick.Illumination)
+	}
+	if brick.MapDiffuse != "textures/brick diffuse.jpg" || len(brick.MapDiffuseRepeat) != 3 || len(brick.MapDiffuseOffset) != 2 {
+		t.Errorf("bad diffuse map %q %v %v", brick.MapDiffuse, brick.MapDiffuseRepeat, brick.MapDiffuseOffset)
+	}
+	if brick.MapBump != "brick_bump.png" || brick.MapBumpScale != 0.3 {
+		t.Errorf("bad bump map %q %v", brick.MapBump, brick.MapBumpScale)
+	}
+	if brick.MapSpecular != "spec.png" || brick.Illumination != 2 {
+		t.Errorf("bad specular map or refl %q %v", brick.MapSpecular, brick.Illumination)
+	}
+	if mtls[1].Opacity != 0.4 || mtls[1].MapAlpha != "alpha#2.png" || mtls[1].DbgIndex != 1 {
+		t.Errorf("bad glass %+v", mtls[1])
+	}
+
+	for _, bad := range []string{"Kd 1 1 1\n", "newmtl a\nKd red\n", "newmtl a\nmap_Kd -s 1\n"} {
+		if _, err := MaterialsFromMtl(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestEncodeMtl(t *testing.T) {
+	buf := &bytes.Buffer{}
+	in := []Material{{DbgName: "plain"}, {DbgName: "glass", Opacity: 0.4}}
+	if err := EncodeMtl(buf, in); err != nil {
+		t.Fatal(err)
+	}
+	mtls, err := MaterialsFromMtl(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mtls) != 2 || mtls[0].Opacity != 1 || mtls[1].Opacity != 0.4 {
+		t.Errorf("bad opacity round trip %+v", mtls)
+	}
+}
@@ -0,0 +1,431 @@
+package bin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ThreeJSModelFromObjFS reads a Wavefront OBJ from fsys together with the
+// MTL files its mtllib lines name, resolved relative to the OBJ. A library
+// that cannot be loaded is returned as a warning of kind ErrMissingMaterial
+// and the materials it should have held get generated colors.
+func ThreeJSModelFromObjFS(fsys fs.FS, name string) (*ThreeJSObj, *Binobj, []error, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	dir := path.Dir(name)
+	loadMtl := func(lib string) ([]Material, error) {
+		ph := resolvePath(dir, lib)
+		mf, err := fsys.Open(ph)
+		if err != nil {
+			return nil, &ConvertError{Kind: ErrMissingMaterial, Path: ph, Err: err}
+		}
+		defer mf.Close()
+		mtls, err := MaterialsFromMtl(mf)
+		if err != nil {
+			return nil, &ConvertError{Kind: ErrMissingMaterial, Path: ph, Err: err}
+		}
+		// texture paths in the mtl are relative to it, the model json sits
+		// next to the obj
+		if libDir := path.Dir(strings.ReplaceAll(lib, "\\", "/")); libDir != "." {
+			for i := range mtls {
+				mtls[i].RebaseMaps(libDir)
+			}
+		}
+		return mtls, nil
+	}
+	rd := newObjReader(nil)
+	rd.loadMtl = loadMtl
+	ts, obj, err := rd.read(f)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	ts.Metadata.Source = path.Base(name)
+	return ts, obj, rd.warnings, nil
+}
+
+// ThreeJSModelFromObj reads a Wavefront OBJ. usemtl names are looked up in
+// mtls, mtllib lines are ignored. Materials that are not found are added with
+// a generated color.
+func ThreeJSModelFromObj(data io.Reader, mtls []Material) (*ThreeJSObj, *Binobj, error) {
+	return newObjReader(mtls).read(data)
+}
+
+type objReader struct {
+	obj       *Binobj
+	materials []Material
+	mtlIndex  map[string]int
+	loadMtl   func(lib string) ([]Material, error)
+
+	normals  [][3]float32
+	colors   [][3]float64
+	hasColor bool
+	mtl      int
+	// fallback is the material of faces before any usemtl, kept out of
+	// mtlIndex so it cannot merge with a material called default.
+	fallback int
+	warnings []error
+}
+
+func newObjReader(mtls []Material) *objReader {
+	rd := &objReader{obj: &Binobj{}, mtlIndex: make(map[string]int), mtl: -1, fallback: -1}
+	rd.addMaterials(mtls)
+	return rd
+}
+
+func (rd *objReader) read(data io.Reader) (*ThreeJSObj, *Binobj, error) {
+	type objFace struct {
+		corners      [][3]int
+		mtl          int
+		normals, uvs bool
+	}
+	var faces []objFace
+
+	sc := bufio.NewScanner(data)
+	sc.Buffer(nil, 1<<20)
+	line := 0
+	text := ""
+	for sc.Scan() {
+		line++
+		text += sc.Text()
+		if strings.HasSuffix(text, "\\") {
+			text = strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		tokens := strings.Fields(text)
+		text = ""
+		if len(tokens) == 0 {
+			continue
+		}
+
+		var err error
+		switch args := tokens[1:]; tokens[0] {
+		case "v":
+			err = rd.vertex(args)
+		case "vn":
+			var v []float64
+			if v, err = parseFloats(args, 3, 3); err == nil {
+				rd.normals = append(rd.normals, [3]float32{float32(v[0]), float32(v[1]), float32(v[2])})
+			}
+		case "vt":
+			var v []float64
+			if v, err = parseFloats(args, 1, 3); err == nil {
+				uv := [2]float32{float32(v[0])}
+				if len(v) > 1 {
+					uv[1] = float32(v[1])
+				}
+				rd.obj.UVs = append(rd.obj.UVs, uv)
+			}
+		case "f":
+			if len(args) < 3 {
+				err = errors.New("face needs 3 vertices")
+				break
+			}
+			fc := objFace{corners: make([][3]int, len(args)), normals: true, uvs: true}
+			for i, a := range args {
+				if fc.corners[i], err = rd.corner(a); err != nil {
+					break
+				}
+				fc.uvs = fc.uvs && fc.corners[i][1] >= 0
+				fc.normals = fc.normals && fc.corners[i][2] >= 0
+			}
+			fc.mtl = rd.mtl
+			faces = append(faces, fc)
+		case "usemtl":
+			rd.mtl = -1
+			if len(args) > 0 {
+				rd.mtl = rd.material(strings.Join(args, " "))
+			}
+		case "mtllib":
+			if rd.loadMtl != nil {
+				for _, lib := range args {
+					mtls, lerr := rd.loadMtl(lib)
+					if lerr != nil {
+						rd.warnings = append(rd.warnings, fmt.Errorf("line %d: %w", line, lerr))
+						continue
+					}
+					rd.addMaterials(mtls)
+				}
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	obj := rd.obj
+	if rd.hasColor {
+		obj.Colors = make([]uint32, len(rd.colors))
+		for i, c := range rd.colors {
+			b := colorBytes(c[:])
+			obj.Colors[i] = uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+	}
+	obj.SetNormals(rd.normals)
+
+	for _, fc := range faces {
+		mtl := fc.mtl
+		if mtl < 0 {
+			if rd.fallback < 0 {
+				rd.fallback = len(rd.materials)
+				rd.materials = append(rd.materials, defaultMaterial(rd.fallback))
+			}
+			mtl = rd.fallback
+		}
+		if mtl > math.MaxUint16 {
+			return nil, nil, fmt.Errorf("material index %d overflow", mtl)
+		}
+		emit := func(corners ...[3]int) {
+			var vt, nl, uv, cl [4]uint32
+			for i, c := range corners {
+				vt[i] = uint32(c[0])
+				uv[i] = uint32(max(c[1], 0))
+				nl[i] = uint32(max(c[2], 0))
+				cl[i] = vt[i]
+			}
+			var clp *[4]uint32
+			if rd.hasColor {
+				clp = &cl
+			}
+			obj.addFace(len(corners), vt, nl, uv, clp, uint16(mtl), fc.normals, fc.uvs)
+		}
+		if len(fc.corners) <= 4 {
+			emit(fc.corners...)
+			continue
+		}
+		// polygons with more than four corners are split into a triangle fan
+		for i := 1; i+1 < len(fc.corners); i++ {
+			emit(fc.corners[0], fc.corners[i], fc.corners[i+1])
+		}
+	}
+	obj.Setup()
+
+	ts := &ThreeJSObj{
+		Metadata:  newMetadata(obj, len(rd.materials)),
+		Materials: rd.materials,
+		Topology:  identityTopology(),
+	}
+	return ts, obj, nil
+}
+
+func (rd *objReader) addMaterials(mtls []Material) {
+	for _, m := range mtls {
+		if _, ok := rd.mtlIndex[m.DbgName]; ok {
+			continue
+		}
+		m.DbgIndex = uint32(len(rd.materials))
+		rd.mtlIndex[m.DbgName] = len(rd.materials)
+		rd.materials = append(rd.materials, m)
+	}
+}
+
+func (rd *objReader) material(name string) int {
+	if i, ok := rd.mtlIndex[name]; ok {
+		return i
+	}
+	m := defaultMaterial(len(rd.materials))
+	m.DbgName = name
+	rd.addMaterials([]Material{m})
+	return rd.mtlIndex[m.DbgName]
+}
+
+func (rd *objReader) vertex(args []string) error {
+	v, err := parseFloats(args, 3, 7)
+	if err != nil {
+		return err
+	}
+	rd.obj.Vectilers = append(rd.obj.Vectilers, [3]float32{float32(v[0]), float32(v[1]), float32(v[2])})
+	// "v x y z r g b" carries a vertex color, "v x y z w" a weight
+	cl := [3]float64{1, 1, 1}
+	if len(v) >= 6 {
+		copy(cl[:], v[3:6])
+		rd.hasColor = true
+	}
+	rd.colors = append(rd.colors, cl)
+	return nil
+}
+
+// corner parses v, v/vt, v//vn or v/vt/vn into zero based indices, -1 where
+// the element is missing.
+func (rd *objReader) corner(s string) ([3]int, error) {
+	ret := [3]int{-1, -1, -1}
+	counts := [3]int{len(rd.obj.Vectilers), len(rd.obj.UVs), len(rd.normals)}
+	for i, p := range strings.SplitN(s, "/", 3) {
+		if p == "" {
+			if i == 0 {
+				return ret, fmt.Errorf("bad face corner %q", s)
+			}
+			continue
+		}
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return ret, err
+		}
+		if v < 0 {
+			v += counts[i]
+		} else {
+			v--
+		}
+		if v < 0 || v >= counts[i] {
+			return ret, fmt.Errorf("index %s out of %d", p, counts[i])
+		}
+		ret[i] = v
+	}
+	return ret, nil
+}
+
+func parseFloats(args []string, minCount, maxCount int) ([]float64, error) {
+	if len(args) < minCount {
+		return nil, fmt.Errorf("need %d values, got %d", minCount, len(args))
+	}
+	if len(args) > maxCount {
+		args = args[:maxCount]
+	}
+	ret := make([]float64, len(args))
+	for i, a := range args {
+		v, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = v
+	}
+	return ret, nil
+}
+
+// WriteObj writes obj as a Wavefront OBJ to fpath and the materials of ts to
+// a .mtl next to it.
+func WriteObj(ts *ThreeJSObj, obj *Binobj, fpath string) error {
+	dir, name := filepath.Split(fpath)
+	lib := strings.TrimSuffix(name, filepath.Ext(name)) + ".mtl"
+
+	var mtls []Material
+	if ts != nil {
+		mtls = ts.Materials
+	}
+	mf, err := os.Create(filepath.Join(dir, lib))
+	if err != nil {
+		return err
+	}
+	err = EncodeMtl(mf, mtls)
+	mf.Close()
+	if err != nil {
+		return err
+	}
+
+	of, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	err = EncodeObj(of, obj, mtls, lib)
+	if cerr := of.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// EncodeObj writes obj as a Wavefront OBJ. Quads stay quads, faces are
+// grouped by material and usemtl uses the names EncodeMtl gives mtls.
+// mtllib is left out when empty.
+func EncodeObj(wr io.Writer, obj *Binobj, mtls []Material, mtllib string) error {
+	w := bufio.NewWriter(wr)
+	fmt.Fprintf(w, "# generated by go-3jsbin\n")
+	if mtllib != "" {
+		fmt.Fprintf(w, "mtllib %s\n", mtllib)
+	}
+
+	// obj has no face colors, each vertex takes the color of a corner using it
+	var vcolors []uint32
+	if len(obj.Colors) > 0 {
+		vcolors = make([]uint32, len(obj.Vectilers))
+		for i := range vcolors {
+			vcolors[i] = 0xffffff
+		}
+		for _, fb := range obj.faceBuckets() {
+			for i, c := range fb.colors {
+				if i < len(fb.vertices) && int(fb.vertices[i]) < len(vcolors) && int(c) < len(obj.Colors) {
+					vcolors[fb.vertices[i]] = obj.Colors[c]
+				}
+			}
+		}
+	}
+	for i, v := range obj.Vectilers {
+		if vcolors != nil {
+			c := vcolors[i]
+			fmt.Fprintf(w, "v %g %g %g %g %g %g\n", v[0], v[1], v[2], float32(c>>16&0xff)/255, float32(c>>8&0xff)/255, float32(c&0xff)/255)
+		} else {
+			fmt.Fprintf(w, "v %g %g %g\n", v[0], v[1], v[2])
+		}
+	}
+	for _, uv := range obj.UVs {
+		fmt.Fprintf(w, "vt %g %g\n", uv[0], uv[1])
+	}
+	for _, n := range obj.GetDecodedNormals() {
+		fmt.Fprintf(w, "vn %g %g %g\n", n[0], n[1], n[2])
+	}
+
+	type objFace struct {
+		fb  *faceBucket
+		idx int
+		mtl uint16
+	}
+	var faces []objFace
+	buckets := obj.faceBuckets()
+	for b := range buckets {
+		fb := &buckets[b]
+		for i := 0; i < fb.faces(); i++ {
+			var mtl uint16
+			if i < len(fb.material) {
+				mtl = fb.material[i]
+			}
+			faces = append(faces, objFace{fb: fb, idx: i, mtl: mtl})
+		}
+	}
+	sort.SliceStable(faces, func(i, j int) bool { return faces[i].mtl < faces[j].mtl })
+
+	names := mtlNames(mtls)
+	cur := -1
+	for _, f := range faces {
+		if int(f.mtl) != cur {
+			cur = int(f.mtl)
+			name := fmt.Sprintf("material_%d", cur)
+			if cur < len(names) {
+				name = names[cur]
+			}
+			fmt.Fprintf(w, "usemtl %s\n", name)
+		}
+		fb := f.fb
+		w.WriteString("f")
+		for k := f.idx * fb.corners; k < (f.idx+1)*fb.corners; k++ {
+			fmt.Fprintf(w, " %d", fb.vertices[k]+1)
+			switch {
+			case k < len(fb.uvs) && k < len(fb.normals):
+				fmt.Fprintf(w, "/%d/%d", fb.uvs[k]+1, fb.normals[k]+1)
+			case k < len(fb.uvs):
+				fmt.Fprintf(w, "/%d", fb.uvs[k]+1)
+			case k < len(fb.normals):
+				fmt.Fprintf(w, "//%d", fb.normals[k]+1)
+			}
+		}
+		w.WriteString("\n")
+	}
+	return w.Flush()
+}
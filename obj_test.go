@@ -0,0 +1,140 @@
+package bin
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const testObj = `# two quads and a pentagon
+mtllib mtl/box.mtl
+o box
+v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0
+v 0.5 1.5 0
+vt 0 0
+vt 1 0
+vt 1 1
+vt 0 1
+vn 0 0 2
+usemtl red
+f 1/1/1 2/2/1 3/3/1 4/4/1
+f 1 2 \
+  3
+usemtl blue
+f -5//1 -4//1 -3//1
+f 1/1 2/2 3/3 5/4 4/4
+`
+
+const testObjMtl = `newmtl red
+Kd 1 0 0
+map_Kd red.png
+newmtl unused
+Kd 0 1 0
+`
+
+func TestThreeJSModelFromObjFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"models/box.obj":     &fstest.MapFile{Data: []byte(testObj)},
+		"models/mtl/box.mtl": &fstest.MapFile{Data: []byte(testObjMtl)},
+	}
+	ts, obj, _, err := ThreeJSModelFromObjFS(fsys, "models/box.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.Materials) != 3 || ts.Materials[2].DbgName != "blue" || ts.Materials[0].MapDiffuse != "mtl/red.png" {
+		t.Fatalf("bad materials %+v", ts.Materials)
+	}
+	if obj.Normals[0] != [3]int8{0, 0, 127} {
+		t.Errorf("normal not quantized %v", obj.Normals)
+	}
+	if len(obj.SmoothUVQuad.Vertices) != 1 || obj.SmoothUVQuad.Uvs[0] != [4]uint32{0, 1, 2, 3} || obj.SmoothUVQuad.Material[0] != 0 {
+		t.Errorf("bad smooth uv quad %+v", obj.SmoothUVQuad)
+	}
+	if len(obj.FlatTriangle.Vertices) != 1 || obj.FlatTriangle.Material[0] != 0 {
+		t.Errorf("continued line not read %+v", obj.FlatTriangle)
+	}
+	if len(obj.SmoothTriangle.Vertices) != 1 || obj.SmoothTriangle.Vertices[0] != [3]uint32{0, 1, 2} || obj.SmoothTriangle.Material[0] != 2 {
+		t.Errorf("negative indices not resolved %+v", obj.SmoothTriangle)
+	}
+	if len(obj.FlatUVTriangle.Vertices) != 3 || obj.FlatUVTriangle.Vertices[2] != [3]uint32{0, 4, 3} {
+		t.Errorf("pentagon not fanned %+v", obj.FlatUVTriangle)
+	}
+	md := ts.Metadata
+	if md.VerticeCount != 5 || md.FaceCount != 6 || md.UVCount != 4 || md.NormalCount != 1 || md.Materials != 3 || md.Source != "box.obj" {
+		t.Errorf("bad metadata %+v", md)
+	}
+	if fds := obj.ValidateMaterials(len(ts.Materials)); len(fds) != 0 {
+		t.Errorf("unexpected findings %v", fds)
+	}
+	if _, err := Decode(bytes.NewReader(encodeBytes(t, obj))); err != nil {
+		t.Errorf("encoded obj not decodable: %v", err)
+	}
+
+	for _, bad := range []string{"f 1 2 3\n", "v 0 0 0\nf 1 2\n", "v 0 0\n", "v 0 0 0\nf 1/x 1 1\n"} {
+		if _, _, err := ThreeJSModelFromObj(strings.NewReader(bad), nil); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestObjMissingMtl(t *testing.T) {
+	fsys := fstest.MapFS{
+		"box.obj": &fstest.MapFile{Data: []byte("mtllib gone.mtl\nv 0 0 0\nv 1 0 0\nv 1 1 0\nf 1 2 3\nusemtl default\nf 3 2 1\n")},
+	}
+	ts, obj, warnings, err := ThreeJSModelFromObjFS(fsys, "box.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !errors.Is(warnings[0], ErrMissingMaterial) {
+		t.Errorf("bad warnings %v", warnings)
+	}
+	if len(ts.Materials) != 2 || obj.FlatTriangle.Material[0] == obj.FlatTriangle.Material[1] {
+		t.Errorf("faces without usemtl merged into default: %+v %v", ts.Materials, obj.FlatTriangle.Material)
+	}
+}
+
+func TestWriteObj(t *testing.T) {
+	fsys := fstest.MapFS{
+		"models/box.obj":     &fstest.MapFile{Data: []byte(testObj)},
+		"models/mtl/box.mtl": &fstest.MapFile{Data: []byte(testObjMtl)},
+	}
+	ts, obj, _, err := ThreeJSModelFromObjFS(fsys, "models/box.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Materials[0].DbgName = "red paint"
+	ts.Materials[0].MapDiffuseRepeat = []float64{2, 2}
+	ts.Materials[0].MapBump = "bump.png"
+	ts.Materials[0].MapBumpScale = 0.5
+
+	dir := t.TempDir()
+	if err := WriteObj(ts, obj, filepath.Join(dir, "out.obj")); err != nil {
+		t.Fatal(err)
+	}
+	ts2, obj2, _, err := ThreeJSModelFromObjFS(os.DirFS(dir), "out.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ts2.Materials[0]
+	if len(ts2.Materials) != 3 || m.DbgName != "red_paint" || m.MapDiffuse != "mtl/red.png" || len(m.MapDiffuseRepeat) != 2 || m.MapBumpScale != 0.5 {
+		t.Errorf("materials not preserved %+v", ts2.Materials)
+	}
+	for i, fb := range obj.faceBuckets() {
+		fb2 := obj2.faceBuckets()[i]
+		if !reflect.DeepEqual(fb.vertices, fb2.vertices) || !reflect.DeepEqual(fb.normals, fb2.normals) ||
+			!reflect.DeepEqual(fb.uvs, fb2.uvs) || !reflect.DeepEqual(fb.material, fb2.material) {
+			t.Errorf("%s changed: %+v != %+v", fb.bucket, fb, fb2)
+		}
+	}
+	if !reflect.DeepEqual(obj.Normals, obj2.Normals) || !reflect.DeepEqual(obj.UVs, obj2.UVs) || !reflect.DeepEqual(obj.Vectilers, obj2.Vectilers) {
+		t.Errorf("arrays changed")
+	}
+}
@@ -0,0 +1,139 @@
+package bin
+
+import (
+	"fmt"
+
+	"github.com/flywave/go3d/vec3"
+)
+
+type Stats struct {
+	// Faces is the face count per Bucket, Triangles the triangle count once
+	// quads are split.
+	Faces     [8]int
+	Triangles int
+
+	Vertices, Normals, UVs, Colors int
+	// UnusedVertices, UnusedNormals and UnusedUVs are never referenced by a
+	// face.
+	UnusedVertices, UnusedNormals, UnusedUVs int
+
+	// Min and Max bound all vertices, used or not.
+	Min, Max [3]float32
+
+	// Materials is indexed by material id, up to the highest id in use.
+	Materials []MaterialStats
+}
+
+type MaterialStats struct {
+	Faces     int
+	Triangles int
+	// Area is the surface in model units, before the topology transform.
+	Area float64
+}
+
+// Stats counts what makes up obj. Faces with vertex indices out of range
+// are counted but add no area; Validate reports them.
+func (obj *Binobj) Stats() *Stats {
+	s := &Stats{
+		Vertices: len(obj.Vectilers),
+		Normals:  len(obj.Normals),
+		UVs:      len(obj.UVs),
+		Colors:   len(obj.Colors),
+	}
+	box, _ := obj.Bounds(nil)
+	for k := range box.Min {
+		s.Min[k], s.Max[k] = float32(box.Min[k]), float32(box.Max[k])
+	}
+
+	usedV := make([]bool, len(obj.Vectilers))
+	usedN := make([]bool, len(obj.Normals))
+	usedU := make([]bool, len(obj.UVs))
+	mark := func(used []bool, idx []uint32) {
+		for _, i := range idx {
+			if int(i) < len(used) {
+				used[i] = true
+			}
+		}
+	}
+	for _, fb := range obj.faceBuckets() {
+		n := fb.faces()
+		s.Faces[fb.bucket] = n
+		mark(usedV, fb.vertices)
+		mark(usedN, fb.normals)
+		mark(usedU, fb.uvs)
+		for f := 0; f < n; f++ {
+			var mtl *MaterialStats
+			if f < len(fb.material) {
+				id := int(fb.material[f])
+				for len(s.Materials) <= id {
+					s.Materials = append(s.Materials, MaterialStats{})
+				}
+				mtl = &s.Materials[id]
+			} else {
+				mtl = &MaterialStats{}
+			}
+			vt := fb.vertices[f*fb.corners : (f+1)*fb.corners]
+			mtl.Faces++
+			mtl.Triangles += fb.corners - 2
+			s.Triangles += fb.corners - 2
+			mtl.Area += obj.triangleArea(vt[0], vt[1], vt[2])
+			if fb.corners == 4 {
+				mtl.Area += obj.triangleArea(vt[2], vt[3], vt[0])
+			}
+		}
+	}
+	s.UnusedVertices = countFalse(usedV)
+	s.UnusedNormals = countFalse(usedN)
+	s.UnusedUVs = countFalse(usedU)
+	return s
+}
+
+func (obj *Binobj) triangleArea(a, b, c uint32) float64 {
+	n := uint32(len(obj.Vectilers))
+	if a >= n || b >= n || c >= n {
+		return 0
+	}
+	pa, pb, pc := vec3.T(obj.Vectilers[a]), vec3.T(obj.Vectilers[b]), vec3.T(obj.Vectilers[c])
+	e1, e2 := vec3.Sub(&pb, &pa), vec3.Sub(&pc, &pa)
+	cr := vec3.Cross(&e1, &e2)
+	return float64(cr.Length()) / 2
+}
+
+func countFalse(bs []bool) int {
+	n := 0
+	for _, b := range bs {
+		if !b {
+			n++
+		}
+	}
+	return n
+}
+
+// Mismatches lists the counts of md that disagree with the header of obj.
+// Colors are only compared when obj carries them.
+func (md *Metadata) Mismatches(obj *Binobj) []string {
+	want := newMetadata(obj, 0)
+	var ret []string
+	check := func(name string, got, want uint32) {
+		if got != want {
+			ret = append(ret, fmt.Sprintf("%s: metadata %d, header %d", name, got, want))
+		}
+	}
+	check("vertices", md.VerticeCount, want.VerticeCount)
+	check("faces", md.FaceCount, want.FaceCount)
+	check("normals", md.NormalCount, want.NormalCount)
+	check("uvs", md.UVCount, want.UVCount)
+	if len(obj.Colors) > 0 {
+		check("colors", md.ColorsCount, want.ColorsCount)
+	}
+	return ret
+}
+
+// Area is the total surface of all faces.
+func (s *Stats) Area() float64 {
+	a := 0.0
+	for _, m := range s.Materials {
+		a += m.Area
+	}
+	return a
+}
@@ -0,0 +1,39 @@
+package bin
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	ts, obj, err := ThreeJSModelFromJson(strings.NewReader(cubeFaceJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Vectilers = append(obj.Vectilers, [3]float32{5, -1, 0})
+	obj.Header.VerticeCount++
+
+	st := obj.Stats()
+	if st.Faces[BucketFlatTriangle] != 1 || st.Faces[BucketFlatUVTriangle] != 1 || st.Faces[BucketSmoothUVQuad] != 1 || st.Triangles != 4 {
+		t.Errorf("bad face counts %v %d", st.Faces, st.Triangles)
+	}
+	if st.UnusedVertices != 1 || st.UnusedNormals != 0 || st.UnusedUVs != 0 {
+		t.Errorf("bad unused counts %+v", st)
+	}
+	if st.Min != [3]float32{0, -1, 0} || st.Max != [3]float32{5, 1, 0} {
+		t.Errorf("bad bounds %v %v", st.Min, st.Max)
+	}
+	if len(st.Materials) != 1 || st.Materials[0].Faces != 3 || math.Abs(st.Area()-2) > 1e-6 {
+		t.Errorf("bad materials %+v", st.Materials)
+	}
+
+	mm := ts.Metadata.Mismatches(obj)
+	if len(mm) != 4 || mm[0] != "vertices: metadata 4, header 5" {
+		t.Errorf("bad mismatches %q", mm)
+	}
+	md := newMetadata(obj, 1)
+	if mm := md.Mismatches(obj); len(mm) != 0 {
+		t.Errorf("unexpected mismatches %q", mm)
+	}
+}
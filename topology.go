@@ -2,7 +2,15 @@ package bin
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
 	"strconv"
+
+	dmat "github.com/flywave/go3d/float64/mat4"
+	dquat "github.com/flywave/go3d/float64/quaternion"
+	dvec3 "github.com/flywave/go3d/float64/vec3"
 )
 
 type Anchor struct {
@@ -12,112 +20,486 @@ type Anchor struct {
 	Name   string    `json:"name"`
 }
 
+// UnmarshalJSON is lenient: null vector entries read as 0 and the unit may
+// be a string. See AnchorFromJson for the strict form.
 func (a *Anchor) UnmarshalJSON(bt []byte) error {
-	var mp map[string]interface{}
-	err := json.Unmarshal(bt, &mp)
-	if err != nil {
-		return err
+	return jsonDecoder{}.anchor("anchor", bt, a)
+}
+
+// MarshalJSON always writes three values for the normal and center.
+func (a Anchor) MarshalJSON() ([]byte, error) {
+	n, c := a.normal(), a.center()
+	return json.Marshal(struct {
+		Normal []float64 `json:"normal"`
+		Center []float64 `json:"center"`
+		Unit   float64   `json:"unit"`
+		Name   string    `json:"name"`
+	}{n[:], c[:], a.Unit, a.Name})
+}
+
+// Topology places a model. Rotation is a quaternion x, y, z, w or, with
+// three values, Euler angles in radians applied in three.js XYZ order.
+type Topology struct {
+	Scale       float64   `json:"scale"`
+	Rotation    []float64 `json:"rotation"`
+	AnchorCount int       `json:"anchorcount"`
+	Anchors     []Anchor  `json:"anchors"`
+	Offset      []float64 `json:"offset"`
+	// AxisScale is the per-axis scale read from a "scale" array; when it is
+	// set Scale is ignored.
+	AxisScale []float64 `json:"-"`
+}
+
+// UnmarshalJSON is lenient: null vector entries read as 0, the scale may be
+// a string and unknown keys are ignored. See TopologyFromJson for the strict
+// form.
+func (a *Topology) UnmarshalJSON(bt []byte) error {
+	return jsonDecoder{}.topology("topology", bt, a)
+}
+
+// MarshalJSON writes the normalized topology: a scale of 0 becomes 1,
+// missing rotation and offset are written as identity and anchorcount is the
+// number of anchors.
+func (a Topology) MarshalJSON() ([]byte, error) {
+	id := identityTopology()
+	var scale interface{} = a.Scale
+	if len(a.AxisScale) == 3 {
+		scale = a.AxisScale
+	} else if a.Scale == 0 {
+		scale = id.Scale
+	}
+	if len(a.Rotation) != 4 && len(a.Rotation) != 3 {
+		a.Rotation = id.Rotation
 	}
+	if len(a.Offset) != 3 {
+		var off [3]float64
+		copy(off[:], a.Offset)
+		a.Offset = off[:]
+	}
+	if a.Anchors == nil {
+		a.Anchors = []Anchor{}
+	}
+	return json.Marshal(struct {
+		Scale       interface{} `json:"scale"`
+		Rotation    []float64   `json:"rotation"`
+		AnchorCount int         `json:"anchorcount"`
+		Anchors     []Anchor    `json:"anchors"`
+		Offset      []float64   `json:"offset"`
+	}{scale, a.Rotation, len(a.Anchors), a.Anchors, a.Offset})
+}
 
-	if rt, ok := mp["normal"]; ok {
-		nl := rt.([]interface{})
-		for _, n := range nl {
-			if n == nil {
-				a.Normal = append(a.Normal, 0)
+// TopologyFromJson decodes a topology. In strict mode numbers must be json
+// numbers, vectors have their exact length without nulls and unknown keys
+// are errors. Errors are *JSONError.
+func TopologyFromJson(bt []byte, strict bool) (*Topology, error) {
+	tp := &Topology{}
+	if err := (jsonDecoder{strict: strict}).topology("topology", bt, tp); err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
 
-			} else {
-				a.Normal = append(a.Normal, n.(float64))
-			}
-		}
+// AnchorFromJson decodes one anchor, see TopologyFromJson.
+func AnchorFromJson(bt []byte, strict bool) (*Anchor, error) {
+	a := &Anchor{}
+	if err := (jsonDecoder{strict: strict}).anchor("anchor", bt, a); err != nil {
+		return nil, err
 	}
+	return a, nil
+}
+
+// JSONError is a decoding error at Path, such as
+// topology.anchors[1].center[2].
+type JSONError struct {
+	Path string
+	Err  error
+}
 
-	if rt, ok := mp["center"]; ok {
-		ct := rt.([]interface{})
-		for _, n := range ct {
-			if n == nil {
-				a.Center = append(a.Center, 0)
+func (e *JSONError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
 
-			} else {
-				a.Center = append(a.Center, n.(float64))
+func (e *JSONError) Unwrap() error {
+	return e.Err
+}
+
+type jsonDecoder struct {
+	strict bool
+}
+
+func (d jsonDecoder) errorf(path, format string, args ...interface{}) error {
+	return &JSONError{Path: path, Err: fmt.Errorf(format, args...)}
+}
+
+// object splits an object into its members, rejecting keys not in known
+// when strict. null is an empty object.
+func (d jsonDecoder) object(path string, bt []byte, known ...string) (map[string]json.RawMessage, error) {
+	var mp map[string]json.RawMessage
+	if err := json.Unmarshal(bt, &mp); err != nil {
+		return nil, d.errorf(path, "expected object, got %s", jsonKind(bt))
+	}
+	if d.strict {
+		for k := range mp {
+			ok := false
+			for _, kn := range known {
+				ok = ok || k == kn
+			}
+			if !ok {
+				return nil, d.errorf(path+"."+k, "unknown key")
 			}
 		}
 	}
+	return mp, nil
+}
 
-	if v, ok := mp["name"]; ok {
-		a.Name = v.(string)
+func (d jsonDecoder) number(path string, bt []byte) (float64, error) {
+	var v interface{}
+	if err := json.Unmarshal(bt, &v); err != nil {
+		return 0, d.errorf(path, "%v", err)
 	}
-
-	if v, ok := mp["unit"]; ok {
-		switch unit := v.(type) {
-		case float64:
-			a.Unit = unit
-		case string:
-			var err error
-			a.Unit, err = strconv.ParseFloat(unit, 64)
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case nil:
+		if !d.strict {
+			return 0, nil
+		}
+	case string:
+		if !d.strict {
+			f, err := strconv.ParseFloat(v, 64)
 			if err != nil {
-				return err
+				return 0, d.errorf(path, "bad number %q", v)
 			}
+			return f, nil
 		}
 	}
-	return nil
+	return 0, d.errorf(path, "expected number, got %s", jsonKind(bt))
 }
 
-type Topology struct {
-	Scale       float64   `json:"scale"`
-	Rotation    []float64 `json:"rotation"`
-	AnchorCount int       `json:"anchorcount"`
-	Anchors     []Anchor  `json:"anchors"`
-	Offset      []float64 `json:"offset"`
+// vector reads an array of numbers; strict mode wants one of the lengths in
+// n.
+func (d jsonDecoder) vector(path string, bt []byte, n ...int) ([]float64, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(bt, &raw); err != nil {
+		return nil, d.errorf(path, "expected array, got %s", jsonKind(bt))
+	}
+	if raw == nil && !d.strict {
+		return nil, nil
+	}
+	if d.strict && !slices.Contains(n, len(raw)) {
+		return nil, d.errorf(path, "expected %v values, got %d", n, len(raw))
+	}
+	ret := make([]float64, len(raw))
+	for i, r := range raw {
+		v, err := d.number(fmt.Sprintf("%s[%d]", path, i), r)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = v
+	}
+	return ret, nil
 }
 
-func (a *Topology) UnmarshalJSON(bt []byte) error {
-	var mp map[string]interface{}
-	err := json.Unmarshal(bt, &mp)
+func (d jsonDecoder) anchor(path string, bt []byte, a *Anchor) error {
+	mp, err := d.object(path, bt, "normal", "center", "unit", "name")
 	if err != nil {
 		return err
 	}
-	if v, ok := mp["rotation"]; ok {
-		nl := v.([]interface{})
-		for _, n := range nl {
-			if n == nil {
-				a.Rotation = append(a.Rotation, 0)
+	if v, ok := mp["normal"]; ok {
+		if a.Normal, err = d.vector(path+".normal", v, 3); err != nil {
+			return err
+		}
+	}
+	if v, ok := mp["center"]; ok {
+		if a.Center, err = d.vector(path+".center", v, 3); err != nil {
+			return err
+		}
+	}
+	if v, ok := mp["unit"]; ok {
+		if a.Unit, err = d.number(path+".unit", v); err != nil {
+			return err
+		}
+	}
+	if v, ok := mp["name"]; ok {
+		var name *string
+		if json.Unmarshal(v, &name) != nil || (name == nil && d.strict) {
+			return d.errorf(path+".name", "expected string, got %s", jsonKind(v))
+		}
+		if name != nil {
+			a.Name = *name
+		}
+	}
+	return nil
+}
 
-			} else {
-				a.Rotation = append(a.Rotation, n.(float64))
+func (d jsonDecoder) topology(path string, bt []byte, a *Topology) error {
+	mp, err := d.object(path, bt, "scale", "rotation", "anchorcount", "anchors", "offset")
+	if err != nil {
+		return err
+	}
+	if v, ok := mp["scale"]; ok {
+		if jsonKind(v) == "array" {
+			sc, err := d.vector(path+".scale", v, 3)
+			if err != nil {
+				return err
 			}
+			switch len(sc) {
+			case 1:
+				a.Scale = sc[0]
+			case 3:
+				a.AxisScale = sc
+			default:
+				return d.errorf(path+".scale", "expected 1 or 3 values, got %d", len(sc))
+			}
+		} else if a.Scale, err = d.number(path+".scale", v); err != nil {
+			return err
+		}
+	}
+	if v, ok := mp["rotation"]; ok {
+		if a.Rotation, err = d.vector(path+".rotation", v, 3, 4); err != nil {
+			return err
 		}
 	}
-
 	if v, ok := mp["offset"]; ok {
-		off := v.([]interface{})
-		for _, n := range off {
-			if n == nil {
-				a.Offset = append(a.Offset, 0)
-
-			} else {
-				a.Offset = append(a.Offset, n.(float64))
-			}
+		if a.Offset, err = d.vector(path+".offset", v, 3); err != nil {
+			return err
 		}
 	}
-
 	if v, ok := mp["anchorcount"]; ok {
-		a.AnchorCount = int(v.(float64))
+		n, err := d.number(path+".anchorcount", v)
+		if err != nil {
+			return err
+		}
+		if n != math.Trunc(n) || n < 0 {
+			return d.errorf(path+".anchorcount", "expected count, got %g", n)
+		}
+		a.AnchorCount = int(n)
 	}
 	if v, ok := mp["anchors"]; ok {
-		bts, _ := json.Marshal(v)
-		json.Unmarshal(bts, &a.Anchors)
-	}
-	if v, ok := mp["scale"]; ok {
-		switch sc := v.(type) {
-		case float64:
-			a.Scale = sc
-		case string:
-			var err error
-			a.Scale, err = strconv.ParseFloat(sc, 64)
-			if err != nil {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(v, &raw); err != nil || (raw == nil && d.strict) {
+			return d.errorf(path+".anchors", "expected array, got %s", jsonKind(v))
+		}
+		a.Anchors = nil
+		for i, r := range raw {
+			a.Anchors = append(a.Anchors, Anchor{})
+			if err := d.anchor(fmt.Sprintf("%s.anchors[%d]", path, i), r, &a.Anchors[i]); err != nil {
 				return err
 			}
 		}
 	}
+	if d.strict && a.AnchorCount != len(a.Anchors) {
+		return d.errorf(path+".anchorcount", "is %d but there are %d anchors", a.AnchorCount, len(a.Anchors))
+	}
 	return nil
 }
+
+// jsonKind names the type of a json value for error messages.
+func jsonKind(bt []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(bt, &v); err != nil {
+		return "invalid json"
+	}
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func identityTopology() Topology {
+	return Topology{Scale: 1, Rotation: []float64{0, 0, 0, 1}, Offset: []float64{0, 0, 0}}
+}
+
+// Transform is the matrix Convert applies to the vertices: scale, then
+// rotation, then offset.
+func (a *Topology) Transform() dmat.T {
+	quat, sc := a.Quaternion(), a.ScaleVec()
+	var off dvec3.T
+	copy(off[:], a.Offset)
+	return *dmat.Compose(&off, &quat, &sc)
+}
+
+// ScaleVec is the scale per axis, AxisScale if it is set and Scale
+// otherwise. A zero Scale counts as 1.
+func (a *Topology) ScaleVec() dvec3.T {
+	if len(a.AxisScale) == 3 {
+		return dvec3.T{a.AxisScale[0], a.AxisScale[1], a.AxisScale[2]}
+	}
+	if a.Scale == 0 {
+		return dvec3.T{1, 1, 1}
+	}
+	return dvec3.T{a.Scale, a.Scale, a.Scale}
+}
+
+// Quaternion is the normalized rotation, converting Euler angles the way
+// three.js does for the XYZ order.
+func (a *Topology) Quaternion() dquat.T {
+	q := dquat.Ident
+	switch len(a.Rotation) {
+	case 3:
+		c1, s1 := math.Cos(a.Rotation[0]/2), math.Sin(a.Rotation[0]/2)
+		c2, s2 := math.Cos(a.Rotation[1]/2), math.Sin(a.Rotation[1]/2)
+		c3, s3 := math.Cos(a.Rotation[2]/2), math.Sin(a.Rotation[2]/2)
+		q = dquat.T{
+			s1*c2*c3 + c1*s2*s3,
+			c1*s2*c3 - s1*c2*s3,
+			c1*c2*s3 + s1*s2*c3,
+			c1*c2*c3 - s1*s2*s3,
+		}
+	case 4:
+		q = dquat.T{a.Rotation[0], a.Rotation[1], a.Rotation[2], a.Rotation[3]}
+	}
+	if q.Norm() == 0 {
+		return dquat.Ident
+	}
+	return q.Normalized()
+}
+
+// WorldAnchors returns the anchors moved by Transform, in the same space as
+// the converted vertices.
+func (a *Topology) WorldAnchors() []Anchor {
+	return a.AnchorsAt(nil)
+}
+
+// AnchorsAt returns the anchors of a model placed by model, which is applied
+// after Transform. A nil model is the identity.
+func (a *Topology) AnchorsAt(model *dmat.T) []Anchor {
+	if len(a.Anchors) == 0 {
+		return nil
+	}
+	mat := a.Transform()
+	if model != nil {
+		mat = *dmat.AssignMul(model, &mat)
+	}
+	ret := make([]Anchor, len(a.Anchors))
+	for i := range a.Anchors {
+		ret[i] = TransformAnchor(&a.Anchors[i], &mat)
+	}
+	return ret
+}
+
+// NearestAnchor returns the index of the anchor closest to p and its
+// distance, with the model placed by model. It returns -1 without anchors.
+func (a *Topology) NearestAnchor(model *dmat.T, p dvec3.T) (int, float64) {
+	best, dist := -1, math.Inf(1)
+	for i, an := range a.AnchorsAt(model) {
+		c := an.center()
+		if d := dvec3.Distance(&c, &p); d < dist {
+			best, dist = i, d
+		}
+	}
+	return best, dist
+}
+
+// MateTransform returns the model transform that puts anchor ai of a onto
+// anchor bi of b, placed by amodel and bmodel: the centers meet and the
+// normals point at each other. The rotation is the shortest one, any twist
+// about the normal is left to the caller. Anchors with different units do
+// not fit; a zero unit matches anything.
+func MateTransform(a *Topology, ai int, amodel *dmat.T, b *Topology, bi int, bmodel *dmat.T) (dmat.T, error) {
+	if ai < 0 || ai >= len(a.Anchors) {
+		return dmat.Ident, fmt.Errorf("anchor %d out of %d", ai, len(a.Anchors))
+	}
+	if bi < 0 || bi >= len(b.Anchors) {
+		return dmat.Ident, fmt.Errorf("anchor %d out of %d", bi, len(b.Anchors))
+	}
+	wa, wb := a.AnchorsAt(amodel)[ai], b.AnchorsAt(bmodel)[bi]
+	if wa.Unit != 0 && wb.Unit != 0 && math.Abs(wa.Unit-wb.Unit) > 1e-6*math.Max(wa.Unit, wb.Unit) {
+		return dmat.Ident, fmt.Errorf("anchor %q has unit %g, %q has %g", wa.Name, wa.Unit, wb.Name, wb.Unit)
+	}
+	na, nb := wa.normal(), wb.normal()
+	if na.Length() == 0 || nb.Length() == 0 {
+		return dmat.Ident, errors.New("anchor without normal")
+	}
+	nb.Invert()
+	q := shortestRotation(&na, &nb)
+
+	ca, cb := wa.center(), wb.center()
+	rc := q.RotatedVec3(&ca)
+	off := dvec3.Sub(&cb, &rc)
+	mat := *dmat.Compose(&off, &q, &dvec3.T{1, 1, 1})
+	if amodel != nil {
+		mat = *dmat.AssignMul(&mat, amodel)
+	}
+	return mat, nil
+}
+
+// Validate checks the length of the rotation and the axis scale, that
+// AnchorCount agrees with Anchors and that every anchor has a 3d center and
+// a non-zero 3d normal.
+func (a *Topology) Validate() error {
+	var errs []error
+	if n := len(a.Rotation); n != 0 && n != 3 && n != 4 {
+		errs = append(errs, fmt.Errorf("rotation has %d values", n))
+	}
+	if n := len(a.AxisScale); n != 0 && n != 3 {
+		errs = append(errs, fmt.Errorf("scale has %d values", n))
+	}
+	if a.AnchorCount != len(a.Anchors) {
+		errs = append(errs, fmt.Errorf("anchorcount is %d but there are %d anchors", a.AnchorCount, len(a.Anchors)))
+	}
+	for i, an := range a.Anchors {
+		if len(an.Center) != 3 {
+			errs = append(errs, fmt.Errorf("anchor %d: center has %d values", i, len(an.Center)))
+		}
+		if n := an.normal(); len(an.Normal) != 3 || n.Length() == 0 {
+			errs = append(errs, fmt.Errorf("anchor %d: bad normal %v", i, an.Normal))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *Anchor) center() dvec3.T {
+	var c dvec3.T
+	copy(c[:], a.Center)
+	return c
+}
+
+func (a *Anchor) normal() dvec3.T {
+	var n dvec3.T
+	copy(n[:], a.Normal)
+	return n
+}
+
+// shortestRotation turns the unit vector from onto to. Opposite vectors
+// are turned half way around an axis perpendicular to both.
+func shortestRotation(from, to *dvec3.T) dquat.T {
+	if dvec3.Dot(from, to) > -0.999999 {
+		return dquat.Vec3Diff(from, to)
+	}
+	axis := dvec3.Cross(from, &dvec3.UnitX)
+	if axis.Length() < 1e-6 {
+		axis = dvec3.Cross(from, &dvec3.UnitY)
+	}
+	axis.Normalize()
+	return dquat.FromAxisAngle(&axis, math.Pi)
+}
+
+// TransformAnchor moves the center of a by mat and turns its normal by the
+// inverse transpose, so it stays perpendicular to the surface under
+// non-uniform scale. Unit grows with the volume scale of mat.
+func TransformAnchor(a *Anchor, mat *dmat.T) Anchor {
+	c, n := a.center(), a.normal()
+	c = mat.MulVec3(&c)
+	nmat := mat.Inverted()
+	nmat.Transpose()
+	n = nmat.MulVec3W(&n, 0)
+	if n.Length() > 0 {
+		n.Normalize()
+	}
+	return Anchor{
+		Normal: n[:],
+		Center: c[:],
+		Unit:   a.Unit * math.Cbrt(math.Abs(mat.Determinant3x3())),
+		Name:   a.Name,
+	}
+}
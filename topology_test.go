@@ -0,0 +1,141 @@
+package bin
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	dmat "github.com/flywave/go3d/float64/mat4"
+	dvec3 "github.com/flywave/go3d/float64/vec3"
+)
+
+func near(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMateTransform(t *testing.T) {
+	a := identityTopology()
+	a.Anchors = []Anchor{
+		{Normal: []float64{1, 0, 0}, Center: []float64{1, 0, 0}, Unit: 1, Name: "a0"},
+		{Normal: []float64{0, 0, 1}, Center: []float64{0, 0, 1}, Unit: 2, Name: "a1"},
+	}
+	a.AnchorCount = 2
+	b := identityTopology()
+	b.Anchors = []Anchor{{Normal: []float64{0, 0, 1}, Center: []float64{0, 5, 0}, Unit: 1, Name: "b0"}}
+	b.AnchorCount = 1
+	bmodel := dmat.Ident
+	bmodel.SetTranslation(&dvec3.T{10, 0, 0})
+
+	if i, d := b.NearestAnchor(&bmodel, dvec3.T{10, 5, 1}); i != 0 || math.Abs(d-1) > 1e-9 {
+		t.Errorf("nearest anchor %d %v", i, d)
+	}
+	if i, _ := a.NearestAnchor(nil, dvec3.T{0, 0, 2}); i != 1 {
+		t.Errorf("expected a1, got %d", i)
+	}
+
+	mat, err := MateTransform(&a, 0, nil, &b, 0, &bmodel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.AnchorsAt(&mat)[0]; !near(got.Center, []float64{10, 5, 0}) || !near(got.Normal, []float64{0, 0, -1}) {
+		t.Errorf("anchors not mated %v %v", got.Center, got.Normal)
+	}
+	if _, err := MateTransform(&a, 1, nil, &b, 0, &bmodel); err == nil {
+		t.Errorf("unit mismatch not reported")
+	}
+
+	// same facing normals need a half turn
+	b.Anchors[0].Normal = []float64{1, 0, 0}
+	mat, err = MateTransform(&a, 0, nil, &b, 0, &bmodel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.AnchorsAt(&mat)[0]; !near(got.Center, []float64{10, 5, 0}) || !near(got.Normal, []float64{-1, 0, 0}) {
+		t.Errorf("anchors not mated %v %v", got.Center, got.Normal)
+	}
+}
+
+func TestTopologyValidate(t *testing.T) {
+	tp := identityTopology()
+	if err := tp.Validate(); err != nil {
+		t.Error(err)
+	}
+	tp.AnchorCount = 2
+	tp.Anchors = []Anchor{{Normal: []float64{0, 0, 0}, Center: []float64{0, 0}}}
+	if err := tp.Validate(); err == nil {
+		t.Error("expected errors")
+	}
+}
+
+func TestTopologyJSON(t *testing.T) {
+	const lenient = `{"scale": "2", "rotation": [0, 0, null, 1], "offset": [1, 2, 3], "anchorcount": 1,
+		"anchors": [{"normal": [0, 0, 1], "center": [1, null, 0], "unit": "0.5", "name": "a"}], "extra": true}`
+	var tp Topology
+	if err := json.Unmarshal([]byte(lenient), &tp); err != nil {
+		t.Fatal(err)
+	}
+	if tp.Scale != 2 || !near(tp.Anchors[0].Center, []float64{1, 0, 0}) || tp.Anchors[0].Unit != 0.5 {
+		t.Errorf("bad topology %+v", tp)
+	}
+	if _, err := TopologyFromJson([]byte(lenient), true); err == nil {
+		t.Error("strict mode accepted strings and nulls")
+	}
+
+	for js, path := range map[string]string{
+		`{"scale": [1, 2]}`:                      "topology.scale",
+		`{"rotation": 1}`:                        "topology.rotation",
+		`{"anchors": [{"normal": [0, "x", 1]}]}`: "topology.anchors[0].normal[1]",
+		`{"anchors": [{"name": 3}]}`:             "topology.anchors[0].name",
+		`{"anchors": {}}`:                        "topology.anchors",
+		`{"anchorcount": 1.5}`:                   "topology.anchorcount",
+		`[]`:                                     "topology",
+	} {
+		var tp Topology
+		err := json.Unmarshal([]byte(js), &tp)
+		var je *JSONError
+		if !errors.As(err, &je) || je.Path != path {
+			t.Errorf("%s: expected error at %s, got %v", js, path, err)
+		}
+	}
+	if _, err := TopologyFromJson([]byte(`{"anchors": [{"normal": [0, 0, 1], "size": 1}]}`), true); err == nil || !strings.Contains(err.Error(), "topology.anchors[0].size") {
+		t.Errorf("unknown key not reported: %v", err)
+	}
+
+	tp.AnchorCount = 5
+	bt, err := json.Marshal(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp2, err := TopologyFromJson(bt, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp2.AnchorCount != 1 || tp2.Anchors[0].Name != "a" || !near(tp2.Offset, tp.Offset) {
+		t.Errorf("bad round trip %s", bt)
+	}
+	bt, _ = json.Marshal(Topology{})
+	if tp2, err := TopologyFromJson(bt, true); err != nil || tp2.Scale != 1 || len(tp2.Rotation) != 4 {
+		t.Errorf("empty topology not normalized %s %v", bt, err)
+	}
+
+	tp2, err = TopologyFromJson([]byte(`{"scale": [1, 2, 3], "rotation": [0, 0, 3.141592653589793]}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := tp2.Quaternion(); tp2.ScaleVec() != (dvec3.T{1, 2, 3}) || math.Abs(math.Abs(q[2])-1) > 1e-9 {
+		t.Errorf("bad axis scale or euler rotation %v %v", tp2.ScaleVec(), q)
+	}
+	if bt, _ = json.Marshal(tp2); !strings.Contains(string(bt), `"scale":[1,2,3]`) {
+		t.Errorf("axis scale not written %s", bt)
+	}
+}
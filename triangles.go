@@ -0,0 +1,66 @@
+package bin
+
+import "iter"
+
+// Triangle is one triangle of a face. Normals, Uvs and Colors index into
+// the arrays of the Binobj and are nil when the bucket has none, or too few
+// for the face.
+type Triangle struct {
+	Vertices [3]uint32
+	Normals  *[3]uint32
+	Uvs      *[3]uint32
+	Colors   *[3]uint32
+	Material uint16
+	Bucket   Bucket
+	// Face is the index of the face within its bucket, Half is 1 for the
+	// second triangle of a quad.
+	Face int
+	Half int
+}
+
+// quadHalves are the corners of the two triangles a quad is split into.
+var quadHalves = [2][3]int{{0, 1, 2}, {2, 3, 0}}
+
+// Triangles yields every triangle of obj, bucket by bucket in Bucket order
+// and faces in order within a bucket. Quads yield corners 0 1 2 and then
+// 2 3 0.
+func (obj *Binobj) Triangles() iter.Seq[Triangle] {
+	return func(yield func(Triangle) bool) {
+		for _, fb := range obj.faceBuckets() {
+			halves := quadHalves[:1]
+			if fb.corners == 4 {
+				halves = quadHalves[:]
+			}
+			for f := 0; f < fb.faces(); f++ {
+				for h, corners := range halves {
+					t := Triangle{Bucket: fb.bucket, Face: f, Half: h}
+					if f < len(fb.material) {
+						t.Material = fb.material[f]
+					}
+					t.Vertices = fb.triangle(fb.vertices, f, corners)
+					end := (f + 1) * fb.corners
+					if end <= len(fb.normals) {
+						n := fb.triangle(fb.normals, f, corners)
+						t.Normals = &n
+					}
+					if end <= len(fb.uvs) {
+						uv := fb.triangle(fb.uvs, f, corners)
+						t.Uvs = &uv
+					}
+					if end <= len(fb.colors) {
+						cl := fb.triangle(fb.colors, f, corners)
+						t.Colors = &cl
+					}
+					if !yield(t) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+func (fb *faceBucket) triangle(idx []uint32, f int, corners [3]int) [3]uint32 {
+	base := f * fb.corners
+	return [3]uint32{idx[base+corners[0]], idx[base+corners[1]], idx[base+corners[2]]}
+}
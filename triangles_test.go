@@ -0,0 +1,43 @@
+package bin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTriangles(t *testing.T) {
+	_, obj, err := ThreeJSModelFromJson(strings.NewReader(cubeFaceJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tris []Triangle
+	for tr := range obj.Triangles() {
+		tris = append(tris, tr)
+	}
+	if len(tris) != 4 {
+		t.Fatalf("got %d triangles", len(tris))
+	}
+	if tr := tris[0]; tr.Bucket != BucketFlatTriangle || tr.Vertices != [3]uint32{0, 1, 2} || tr.Normals != nil || tr.Uvs != nil {
+		t.Errorf("bad flat triangle %+v", tr)
+	}
+	if tr := tris[1]; tr.Bucket != BucketFlatUVTriangle || tr.Normals != nil || tr.Uvs == nil {
+		t.Errorf("bad uv triangle %+v", tr)
+	}
+	for h, tr := range tris[2:] {
+		if tr.Bucket != BucketSmoothUVQuad || tr.Face != 0 || tr.Half != h || tr.Normals == nil || tr.Uvs == nil {
+			t.Errorf("bad quad half %d %+v", h, tr)
+		}
+	}
+	if v, uv := tris[3].Vertices, *tris[3].Uvs; v != [3]uint32{2, 3, 0} || uv != [3]uint32{2, 3, 0} {
+		t.Errorf("bad second half %v %v", v, uv)
+	}
+
+	n := 0
+	for range obj.Triangles() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("iteration not stopped")
+	}
+}
@@ -0,0 +1,211 @@
+package bin
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/flywave/go3d/vec3"
+)
+
+type Bucket int
+
+const (
+	BucketFlatTriangle Bucket = iota
+	BucketSmoothTriangle
+	BucketFlatUVTriangle
+	BucketSmoothUVTriangle
+	BucketFlatQuad
+	BucketSmoothQuad
+	BucketFlatUVQuad
+	BucketSmoothUVQuad
+)
+
+var bucketNames = []string{
+	"FlatTriangle", "SmoothTriangle", "FlatUVTriangle", "SmoothUVTriangle",
+	"FlatQuad", "SmoothQuad", "FlatUVQuad", "SmoothUVQuad",
+}
+
+func (b Bucket) String() string {
+	if int(b) < 0 || int(b) >= len(bucketNames) {
+		return fmt.Sprintf("Bucket(%d)", int(b))
+	}
+	return bucketNames[b]
+}
+
+func (b Bucket) IsQuad() bool {
+	return b >= BucketFlatQuad
+}
+
+func (b Bucket) HasNormals() bool {
+	return b == BucketSmoothTriangle || b == BucketSmoothUVTriangle || b == BucketSmoothQuad || b == BucketSmoothUVQuad
+}
+
+func (b Bucket) HasUvs() bool {
+	return b == BucketFlatUVTriangle || b == BucketSmoothUVTriangle || b == BucketFlatUVQuad || b == BucketSmoothUVQuad
+}
+
+type faceBucket struct {
+	bucket   Bucket
+	corners  int
+	vertices []uint32
+	normals  []uint32
+	uvs      []uint32
+	colors   []uint32
+	material []uint16
+}
+
+func (fb *faceBucket) faces() int {
+	return len(fb.vertices) / fb.corners
+}
+
+func (obj *Binobj) faceBuckets() []faceBucket {
+	return []faceBucket{
+		{bucket: BucketFlatTriangle, corners: 3, vertices: obj.FlatTriangle.GetVertices(), colors: obj.FlatTriangle.GetColors(), material: obj.FlatTriangle.Material},
+		{bucket: BucketSmoothTriangle, corners: 3, vertices: obj.SmoothTriangle.GetVertices(), normals: obj.SmoothTriangle.GetNormals(), colors: obj.SmoothTriangle.GetColors(), material: obj.SmoothTriangle.Material},
+		{bucket: BucketFlatUVTriangle, corners: 3, vertices: obj.FlatUVTriangle.GetVertices(), uvs: obj.FlatUVTriangle.GetUvs(), colors: obj.FlatUVTriangle.GetColors(), material: obj.FlatUVTriangle.Material},
+		{bucket: BucketSmoothUVTriangle, corners: 3, vertices: obj.SmoothUVTriangle.GetVertices(), normals: obj.SmoothUVTriangle.GetNormals(), uvs: obj.SmoothUVTriangle.GetUvs(), colors: obj.SmoothUVTriangle.GetColors(), material: obj.SmoothUVTriangle.Material},
+		{bucket: BucketFlatQuad, corners: 4, vertices: obj.FlatQuad.GetVertices(), colors: obj.FlatQuad.GetColors(), material: obj.FlatQuad.Material},
+		{bucket: BucketSmoothQuad, corners: 4, vertices: obj.SmoothQuad.GetVertices(), normals: obj.SmoothQuad.GetNormals(), colors: obj.SmoothQuad.GetColors(), material: obj.SmoothQuad.Material},
+		{bucket: BucketFlatUVQuad, corners: 4, vertices: obj.FlatUVQuad.GetVertices(), uvs: obj.FlatUVQuad.GetUvs(), colors: obj.FlatUVQuad.GetColors(), material: obj.FlatUVQuad.Material},
+		{bucket: BucketSmoothUVQuad, corners: 4, vertices: obj.SmoothUVQuad.GetVertices(), normals: obj.SmoothUVQuad.GetNormals(), uvs: obj.SmoothUVQuad.GetUvs(), colors: obj.SmoothUVQuad.GetColors(), material: obj.SmoothUVQuad.Material},
+	}
+}
+
+type FindingKind int
+
+const (
+	FindingLengthMismatch FindingKind = iota
+	FindingVertexIndex
+	FindingNormalIndex
+	FindingUVIndex
+	FindingMaterialIndex
+	FindingDegenerate
+	FindingInvalidPosition
+	FindingColorIndex
+)
+
+// Fatal reports whether the finding makes the model unusable, as opposed
+// to a face that only renders badly.
+func (k FindingKind) Fatal() bool {
+	switch k {
+	case FindingDegenerate, FindingInvalidPosition:
+		return false
+	}
+	return true
+}
+
+type Finding struct {
+	Kind    FindingKind
+	Bucket  string
+	Face    int
+	Message string
+}
+
+func (f Finding) Error() string {
+	if f.Face < 0 {
+		return fmt.Sprintf("%s: %s", f.Bucket, f.Message)
+	}
+	return fmt.Sprintf("%s[%d]: %s", f.Bucket, f.Face, f.Message)
+}
+
+// Validate checks the face buckets against the vertex, normal and uv arrays.
+func (obj *Binobj) Validate() []Finding {
+	return obj.validate(-1)
+}
+
+// ValidateMaterials is Validate plus a check of the material indices against
+// mtlCount.
+func (obj *Binobj) ValidateMaterials(mtlCount int) []Finding {
+	return obj.validate(mtlCount)
+}
+
+func (obj *Binobj) validate(mtlCount int) []Finding {
+	var ret []Finding
+
+	for i, v := range obj.Vectilers {
+		for _, c := range v {
+			if math.IsNaN(float64(c)) || math.IsInf(float64(c), 0) {
+				ret = append(ret, Finding{Kind: FindingInvalidPosition, Bucket: "Vectilers", Face: i, Message: fmt.Sprintf("invalid position %v", v)})
+				break
+			}
+		}
+	}
+
+	for _, fb := range obj.faceBuckets() {
+		name := fb.bucket.String()
+		faces := fb.faces()
+		if len(fb.material) != faces {
+			ret = append(ret, Finding{Kind: FindingLengthMismatch, Bucket: name, Face: -1, Message: fmt.Sprintf("%d faces but %d materials", faces, len(fb.material))})
+		}
+		if fb.bucket.HasNormals() && len(fb.normals) != len(fb.vertices) {
+			ret = append(ret, Finding{Kind: FindingLengthMismatch, Bucket: name, Face: -1, Message: fmt.Sprintf("%d faces but %d normals", faces, len(fb.normals)/fb.corners)})
+		}
+		if fb.bucket.HasUvs() && len(fb.uvs) != len(fb.vertices) {
+			ret = append(ret, Finding{Kind: FindingLengthMismatch, Bucket: name, Face: -1, Message: fmt.Sprintf("%d faces but %d uvs", faces, len(fb.uvs)/fb.corners)})
+		}
+		if len(obj.Colors) > 0 && faces > 0 && len(fb.colors) != len(fb.vertices) {
+			ret = append(ret, Finding{Kind: FindingLengthMismatch, Bucket: name, Face: -1, Message: fmt.Sprintf("%d faces but %d colors", faces, len(fb.colors)/fb.corners)})
+		}
+
+		for f := 0; f < faces; f++ {
+			vt := fb.vertices[f*fb.corners : (f+1)*fb.corners]
+			valid := true
+			for _, v := range vt {
+				if int(v) >= len(obj.Vectilers) {
+					ret = append(ret, Finding{Kind: FindingVertexIndex, Bucket: name, Face: f, Message: fmt.Sprintf("vertex index %d out of %d", v, len(obj.Vectilers))})
+					valid = false
+					break
+				}
+			}
+			if (f+1)*fb.corners <= len(fb.normals) {
+				for _, n := range fb.normals[f*fb.corners : (f+1)*fb.corners] {
+					if int(n) >= len(obj.Normals) {
+						ret = append(ret, Finding{Kind: FindingNormalIndex, Bucket: name, Face: f, Message: fmt.Sprintf("normal index %d out of %d", n, len(obj.Normals))})
+						break
+					}
+				}
+			}
+			if (f+1)*fb.corners <= len(fb.uvs) {
+				for _, u := range fb.uvs[f*fb.corners : (f+1)*fb.corners] {
+					if int(u) >= len(obj.UVs) {
+						ret = append(ret, Finding{Kind: FindingUVIndex, Bucket: name, Face: f, Message: fmt.Sprintf("uv index %d out of %d", u, len(obj.UVs))})
+						break
+					}
+				}
+			}
+			if (f+1)*fb.corners <= len(fb.colors) {
+				for _, c := range fb.colors[f*fb.corners : (f+1)*fb.corners] {
+					if int(c) >= len(obj.Colors) {
+						ret = append(ret, Finding{Kind: FindingColorIndex, Bucket: name, Face: f, Message: fmt.Sprintf("color index %d out of %d", c, len(obj.Colors))})
+						break
+					}
+				}
+			}
+			if mtlCount >= 0 && f < len(fb.material) && int(fb.material[f]) >= mtlCount {
+				ret = append(ret, Finding{Kind: FindingMaterialIndex, Bucket: name, Face: f, Message: fmt.Sprintf("material index %d out of %d", fb.material[f], mtlCount)})
+			}
+			if valid && obj.degenerate(vt) {
+				ret = append(ret, Finding{Kind: FindingDegenerate, Bucket: name, Face: f, Message: fmt.Sprintf("degenerate face %v", vt)})
+			}
+		}
+	}
+	return ret
+}
+
+// degenerate reports faces without area. Quads that repeat a vertex are
+// how exporters store triangles in quad buckets and only count when both
+// halves are empty.
+func (obj *Binobj) degenerate(vt []uint32) bool {
+	area := triangleArea(obj.Vectilers[vt[0]], obj.Vectilers[vt[1]], obj.Vectilers[vt[2]])
+	if len(vt) == 4 {
+		area += triangleArea(obj.Vectilers[vt[2]], obj.Vectilers[vt[3]], obj.Vectilers[vt[0]])
+	}
+	return area == 0
+}
+
+func triangleArea(a, b, c [3]float32) float32 {
+	ab := vec3.Sub((*vec3.T)(&b), (*vec3.T)(&a))
+	ac := vec3.Sub((*vec3.T)(&c), (*vec3.T)(&a))
+	cr := vec3.Cross(&ab, &ac)
+	return cr.Length() / 2
+}
@@ -0,0 +1,62 @@
+package bin
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	obj := &Binobj{}
+	obj.SetVectilers([]float32{0, 0, 0, 1, 0, 0, 1, 1, 0, float32(math.NaN()), 0, 0})
+	obj.SetNormals([]int8{0, 0, 127})
+	obj.FlatTriangle.SetVertices([]uint32{0, 1, 2, 0, 1, 1})
+	obj.FlatTriangle.SetMaterial([]uint16{0, 3})
+	obj.SmoothQuad.SetVertices([]uint32{0, 1, 2, 7})
+	obj.SmoothQuad.SetNormals([]uint32{0, 0, 0, 1})
+	obj.SmoothQuad.SetMaterial([]uint16{0})
+	obj.FlatUVTriangle.SetVertices([]uint32{0, 1, 2})
+	obj.FlatUVTriangle.SetUVs([]uint32{0, 0, 5})
+	obj.FlatUVTriangle.SetMaterial([]uint16{0})
+	obj.SetUVs([]float32{0, 0})
+	obj.FlatQuad.SetVertices([]uint32{0, 1, 2, 3})
+
+	want := map[string]FindingKind{
+		"Vectilers[3]":      FindingInvalidPosition,
+		"FlatTriangle[1]":   FindingMaterialIndex,
+		"SmoothQuad[0]":     FindingVertexIndex,
+		"FlatUVTriangle[0]": FindingUVIndex,
+		"FlatQuad":          FindingLengthMismatch,
+	}
+	got := map[FindingKind]int{}
+	for _, fd := range obj.ValidateMaterials(2) {
+		got[fd.Kind]++
+		key := fd.Bucket
+		if fd.Face >= 0 {
+			key = fmt.Sprintf("%s[%d]", fd.Bucket, fd.Face)
+		}
+		if k, ok := want[key]; ok && k == fd.Kind {
+			delete(want, key)
+		}
+	}
+	if len(want) != 0 {
+		t.Errorf("missing findings %v", want)
+	}
+	if got[FindingDegenerate] != 1 || got[FindingNormalIndex] != 1 {
+		t.Errorf("unexpected findings %v", got)
+	}
+}
+
+func TestValidateQuadAsTriangle(t *testing.T) {
+	obj := &Binobj{}
+	obj.SetVectilers([]float32{0, 0, 0, 1, 0, 0, 1, 1, 0})
+	obj.FlatQuad.SetVertices([]uint32{0, 1, 2, 2, 0, 1, 1, 0})
+	obj.FlatQuad.SetMaterial([]uint16{5, 0})
+	fds := obj.Validate()
+	if len(fds) != 1 || fds[0].Kind != FindingDegenerate || fds[0].Face != 1 {
+		t.Errorf("unexpected findings %v", fds)
+	}
+	if fds := obj.ValidateMaterials(1); len(fds) != 2 {
+		t.Errorf("material index not checked %v", fds)
+	}
+}